@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// binaryMagic lists prefixes of common binary formats: images, fonts, archives,
+// executables and class files.
+var binaryMagic = [][]byte{
+	[]byte("\x89PNG\r\n\x1a\n"),
+	[]byte("\xff\xd8\xff"), // JPEG
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+	[]byte("%PDF-"),
+	[]byte("PK\x03\x04"), // zip, jar, docx
+	[]byte("\x1f\x8b"),   // gzip
+	[]byte("\xfd7zXZ\x00"),
+	[]byte("(\xb5/\xfd"), // zstd
+	[]byte("\x7fELF"),
+	[]byte("\xca\xfe\xba\xbe"), // Java class, Mach-O universal
+	[]byte("\xcf\xfa\xed\xfe"), // Mach-O 64-bit
+	[]byte("\x00asm"),          // WebAssembly
+	[]byte("wOFF"),
+	[]byte("wOF2"),
+	[]byte("OTTO"), // OpenType
+}
+
+// sniffLen is how much of a file is checked for NUL bytes and invalid UTF-8, as git does.
+const sniffLen = 8000
+
+// isBinary reports whether the contents of r look like a binary file rather than a template:
+// they start with a known magic number, or their first sniffLen bytes contain a NUL byte or
+// are not valid UTF-8. It reads no more than sniffLen bytes of r.
+func isBinary(r io.Reader) (bool, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+	for _, m := range binaryMagic {
+		if bytes.HasPrefix(head, m) {
+			return true, nil
+		}
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true, nil
+	}
+	if err == nil {
+		// The file goes on, so head may end partway through a character.
+		for i := 1; i <= utf8.UTFMax && i <= n; i++ {
+			if utf8.RuneStart(head[n-i]) {
+				if !utf8.FullRune(head[n-i:]) {
+					head = head[:n-i]
+				}
+				break
+			}
+		}
+	}
+	return !utf8.Valid(head), nil
+}
+
+// isBinaryFile reports whether the file at path in tree looks binary; see isBinary.
+func isBinaryFile(tree sourceTree, path string) (bool, error) {
+	f, _, err := tree.open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return isBinary(f)
+}
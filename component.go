@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	htmltemplate "html/template"
+)
+
+// templateExecutor is the subset of text/template and html/template used to render components.
+type templateExecutor interface {
+	ExecuteTemplate(w io.Writer, name string, data any) error
+}
+
+// componentCall is a component invocation whose body is being captured or rendered.
+type componentCall struct {
+	name  string
+	args  map[string]any
+	slots map[string]string
+	fills []string // slot names being filled, innermost last
+}
+
+// components implements parameterized components with named slots:
+//
+//	{{define "card"}}<div class="{{param "class" "card"}}">
+//	  <h1>{{param "title"}}</h1>{{slot "header"}}
+//	  {{slot}}
+//	</div>{{end}}
+//
+//	{{range $i, $item := .Items}}
+//	{{component "card" (dict "title" $item.Name)}}
+//	  {{fill "header"}}<small>#{{$i}}</small>{{endfill}}
+//	  Body with {{$item.Text}} and {{$.X}} in scope.
+//	{{endcomponent}}
+//	{{end}}
+//
+// Output between component and endcomponent is captured as the default slot,
+// and output between fill and endfill as a named slot, by redirecting the
+// writer the template executes into.
+type components struct {
+	tmpl templateExecutor
+
+	out     io.Writer
+	buffers []*bytes.Buffer
+	calls   []*componentCall // calls whose bodies are being captured
+	active  []*componentCall // calls being rendered
+}
+
+// funcs returns the component functions, bound to the template later passed to execute.
+func (c *components) funcs(htmlMode bool) map[string]any {
+	if htmlMode {
+		return map[string]any{
+			"component": c.component,
+			"fill":      c.fill,
+			"endfill":   c.endfill,
+			"param":     c.param,
+			"endcomponent": func() (htmltemplate.HTML, error) {
+				s, err := c.endcomponent()
+				return htmltemplate.HTML(s), err
+			},
+			"slot": func(name ...string) (htmltemplate.HTML, error) {
+				s, err := c.slot(name...)
+				return htmltemplate.HTML(s), err
+			},
+		}
+	}
+	return map[string]any{
+		"component":    c.component,
+		"endcomponent": c.endcomponent,
+		"fill":         c.fill,
+		"endfill":      c.endfill,
+		"slot":         c.slot,
+		"param":        c.param,
+	}
+}
+
+// Write writes to the innermost capture buffer, or the underlying writer if nothing is being captured.
+func (c *components) Write(p []byte) (int, error) {
+	if n := len(c.buffers); n > 0 {
+		return c.buffers[n-1].Write(p)
+	}
+	return c.out.Write(p)
+}
+
+func (c *components) push() {
+	c.buffers = append(c.buffers, new(bytes.Buffer))
+}
+
+func (c *components) pop() string {
+	n := len(c.buffers)
+	b := c.buffers[n-1]
+	c.buffers = c.buffers[:n-1]
+	return b.String()
+}
+
+// execute runs t into out with the component functions bound to it.
+func (c *components) execute(t templateExecutor, name string, out io.Writer, ctx any) error {
+	c.tmpl, c.out = t, out
+	if err := t.ExecuteTemplate(c, name, ctx); err != nil {
+		return err
+	}
+	if n := len(c.calls); n > 0 {
+		return fmt.Errorf("component %q: missing endcomponent", c.calls[n-1].name)
+	}
+	return nil
+}
+
+func (c *components) component(name string, args ...map[string]any) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("component %q: expected at most one argument map, got %d", name, len(args))
+	}
+	call := &componentCall{name: name, args: map[string]any{}, slots: map[string]string{}}
+	if len(args) == 1 {
+		for k, v := range args[0] {
+			call.args[k] = v
+		}
+	}
+	c.calls = append(c.calls, call)
+	c.push()
+	return "", nil
+}
+
+func (c *components) fill(name string) (string, error) {
+	n := len(c.calls)
+	if n == 0 {
+		return "", fmt.Errorf("fill %q: not inside a component", name)
+	}
+	call := c.calls[n-1]
+	call.fills = append(call.fills, name)
+	c.push()
+	return "", nil
+}
+
+func (c *components) endfill() (string, error) {
+	if len(c.calls) == 0 {
+		return "", fmt.Errorf("endfill: no matching fill")
+	}
+	call := c.calls[len(c.calls)-1]
+	n := len(call.fills)
+	if n == 0 {
+		return "", fmt.Errorf("endfill: no matching fill")
+	}
+	name := call.fills[n-1]
+	call.fills = call.fills[:n-1]
+	call.slots[name] = c.pop()
+	return "", nil
+}
+
+func (c *components) endcomponent() (string, error) {
+	n := len(c.calls)
+	if n == 0 {
+		return "", fmt.Errorf("endcomponent: no matching component")
+	}
+	call := c.calls[n-1]
+	if f := len(call.fills); f > 0 {
+		return "", fmt.Errorf("component %q: fill %q is missing endfill", call.name, call.fills[f-1])
+	}
+	c.calls = c.calls[:n-1]
+	call.slots[""] = c.pop()
+
+	c.active = append(c.active, call)
+	c.push()
+	err := c.tmpl.ExecuteTemplate(c, call.name, call.args)
+	out := c.pop()
+	c.active = c.active[:len(c.active)-1]
+	if err != nil {
+		return "", fmt.Errorf("component %q: %w", call.name, err)
+	}
+	return out, nil
+}
+
+// slot returns the content of the named slot of the component being rendered,
+// or the body of the call if no name is given.
+func (c *components) slot(name ...string) (string, error) {
+	call, err := c.current("slot")
+	if err != nil {
+		return "", err
+	}
+	if len(name) > 1 {
+		return "", fmt.Errorf("slot: expected at most one name, got %d", len(name))
+	}
+	if len(name) == 1 {
+		return call.slots[name[0]], nil
+	}
+	return call.slots[""], nil
+}
+
+// param returns the named argument of the component being rendered.
+// With a default, a missing argument yields the default; without one, it is an error.
+func (c *components) param(name string, def ...any) (any, error) {
+	call, err := c.current("param")
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := call.args[name]; ok {
+		return v, nil
+	}
+	switch len(def) {
+	case 0:
+		return nil, fmt.Errorf("component %q: missing required argument %q", call.name, name)
+	case 1:
+		call.args[name] = def[0]
+		return def[0], nil
+	default:
+		return nil, fmt.Errorf("param %q: expected at most one default, got %d", name, len(def))
+	}
+}
+
+func (c *components) current(fn string) (*componentCall, error) {
+	n := len(c.active)
+	if n == 0 {
+		return nil, fmt.Errorf("%s: not inside a component", fn)
+	}
+	return c.active[n-1], nil
+}
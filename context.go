@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+// withValues returns a copy of ctx with vals merged in using mergeValues.
+// ctx must be nil or a map with string keys, as built by envMap.
+func withValues(ctx any, vals map[string]any) (any, error) {
+	result := map[string]any{}
+	switch c := ctx.(type) {
+	case nil:
+	case map[string]string:
+		for k, v := range c {
+			result[k] = v
+		}
+	case map[string]any:
+		mergeValues(result, c)
+	default:
+		return nil, fmt.Errorf("cannot add values to context of type %T", ctx)
+	}
+	mergeValues(result, vals)
+	return result, nil
+}
+
+// mergeValues merges src into dst. Nested maps are merged recursively and
+// copied rather than shared; any other value in src replaces the one in dst.
+func mergeValues(dst, src map[string]any) {
+	for k, v := range src {
+		sm, ok := v.(map[string]any)
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dm, ok := dst[k].(map[string]any)
+		if !ok {
+			dm = map[string]any{}
+		} else {
+			dm = cloneValues(dm)
+		}
+		mergeValues(dm, sm)
+		dst[k] = dm
+	}
+}
+
+func cloneValues(m map[string]any) map[string]any {
+	c := map[string]any{}
+	mergeValues(c, m)
+	return c
+}
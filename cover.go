@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+)
+
+// coverBlock is a span of a template file counted by -cover: an action,
+// or the body of an if, with or range branch. Lines and columns are 1-based.
+type coverBlock struct {
+	file                string
+	startLine, startCol int
+	endLine, endCol     int
+	count               int64
+}
+
+func (b *coverBlock) key() string {
+	return fmt.Sprintf("%s:%d.%d,%d.%d", b.file, b.startLine, b.startCol, b.endLine, b.endCol)
+}
+
+// coverage collects the blocks of every page rendered in this run.
+var coverage struct {
+	sync.Mutex
+	blocks map[string]*coverBlock
+}
+
+// pageCover instruments one page for -cover.
+type pageCover struct {
+	page    *page
+	src     string      // the source as parsed
+	shifts  map[int]int // from stripBlocksShifts, to map columns in src back to the file
+	actions []coverAction
+	blocks  []*coverBlock
+}
+
+// coverAction is the span of an action in the source, with the clauses of its
+// control structure if it opens one.
+type coverAction struct {
+	start, end int
+	clauses    []int // for if, with and range: indexes of the action and its else and end actions
+	chain      bool  // an else if or else with action
+	group      int   // index of the opening action of the enclosing clause list, or -1
+}
+
+// newPageCover returns a pageCover for p parsed from src, or nil if -cover is not set.
+// shifts are those of src, from stripBlocksShifts.
+func newPageCover(p *page, src string, shifts map[int]int) *pageCover {
+	if *flagCover == "" {
+		return nil
+	}
+	left, right := p.delims()
+	cv := &pageCover{page: p, src: src, shifts: shifts}
+	var stack []int
+	for pos := 0; ; {
+		i := strings.Index(src[pos:], left)
+		if i < 0 {
+			break
+		}
+		n := actionEnd(src[pos+i:], left, right)
+		if n < 0 {
+			break
+		}
+		a := coverAction{start: pos + i, end: pos + i + n, group: -1}
+		k := len(cv.actions)
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(src[a.start+len(left):a.end-len(right)]), "-"))
+		word := ""
+		if len(fields) > 0 {
+			word = fields[0]
+		}
+		switch word {
+		case "if", "with", "range", "define", "block":
+			a.clauses = []int{k}
+			stack = append(stack, k)
+		case "else", "end":
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				cv.actions[top].clauses = append(cv.actions[top].clauses, k)
+				a.group = top
+				a.chain = word == "else" && len(fields) > 1 && (fields[1] == "if" || fields[1] == "with")
+				if word == "end" {
+					stack = stack[:len(stack)-1]
+				}
+			}
+		}
+		cv.actions = append(cv.actions, a)
+		pos = a.end
+	}
+	return cv
+}
+
+// action returns the index of the action containing offset, or -1.
+func (cv *pageCover) action(offset int) int {
+	i := sort.Search(len(cv.actions), func(i int) bool { return cv.actions[i].end > offset })
+	if i < len(cv.actions) && cv.actions[i].start <= offset {
+		return i
+	}
+	return -1
+}
+
+// addBlock registers the span [start, end) of the source and returns its id,
+// or -1 if the page already counts the span, as for a body that is a single action.
+func (cv *pageCover) addBlock(start, end int) int {
+	b := &coverBlock{file: cv.page.displayName()}
+	b.startLine, b.startCol = cv.lineCol(start)
+	b.endLine, b.endCol = cv.lineCol(end)
+	for _, old := range cv.blocks {
+		if old.key() == b.key() {
+			return -1
+		}
+	}
+	coverage.Lock()
+	if coverage.blocks == nil {
+		coverage.blocks = map[string]*coverBlock{}
+	}
+	if old, ok := coverage.blocks[b.key()]; ok {
+		b = old
+	} else {
+		coverage.blocks[b.key()] = b
+	}
+	coverage.Unlock()
+	cv.blocks = append(cv.blocks, b)
+	return len(cv.blocks) - 1
+}
+
+// lineCol returns the line and column in the page's file of offset in the source as parsed.
+func (cv *pageCover) lineCol(offset int) (int, int) {
+	before := cv.src[:offset]
+	line := strings.Count(before, "\n") + 1
+	col := len(before) - strings.LastIndexByte(before, '\n') - cv.shifts[line]
+	return line + cv.page.offset, max(col, 1)
+}
+
+func (cv *pageCover) funcs() template.FuncMap {
+	return template.FuncMap{
+		"tmplCover": func(id int) string {
+			atomic.AddInt64(&cv.blocks[id].count, 1)
+			return ""
+		},
+	}
+}
+
+// rewrite inserts a counter before each action and at the start of each branch body in t.
+func (cv *pageCover) rewrite(t *parse.Tree) error {
+	return cv.rewriteList(t.Root)
+}
+
+func (cv *pageCover) rewriteList(l *parse.ListNode) error {
+	if l == nil {
+		return nil
+	}
+	nodes := make([]parse.Node, 0, len(l.Nodes))
+	for _, n := range l.Nodes {
+		switch n := n.(type) {
+		case *parse.ActionNode, *parse.TemplateNode:
+			if k := cv.action(int(n.Position())); k >= 0 {
+				counter, err := cv.counter(cv.actions[k].start, cv.actions[k].end)
+				if err != nil {
+					return err
+				}
+				if counter != nil {
+					nodes = append(nodes, counter)
+				}
+			}
+		case *parse.IfNode:
+			if err := cv.rewriteBranch(&n.BranchNode); err != nil {
+				return err
+			}
+		case *parse.WithNode:
+			if err := cv.rewriteBranch(&n.BranchNode); err != nil {
+				return err
+			}
+		case *parse.RangeNode:
+			if err := cv.rewriteBranch(&n.BranchNode); err != nil {
+				return err
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	l.Nodes = nodes
+	return nil
+}
+
+// rewriteBranch counts the bodies of b. The span of each body runs from the end
+// of the action opening it to the start of the next clause.
+func (cv *pageCover) rewriteBranch(b *parse.BranchNode) error {
+	k := cv.action(int(b.Position()))
+	if k < 0 {
+		return nil
+	}
+	group := k
+	if cv.actions[k].chain {
+		group = cv.actions[k].group
+	}
+	clauses := cv.actions[group].clauses
+	c := 0
+	for c < len(clauses) && clauses[c] != k {
+		c++
+	}
+	body := func(l *parse.ListNode, c int) error {
+		if l == nil || c+1 >= len(clauses) {
+			return nil
+		}
+		start, end := cv.actions[clauses[c]].end, cv.actions[clauses[c+1]].start
+		if start < end {
+			counter, err := cv.counter(start, end)
+			if err != nil {
+				return err
+			}
+			if counter != nil {
+				l.Nodes = append([]parse.Node{counter}, l.Nodes...)
+			}
+		}
+		return nil
+	}
+	if err := cv.rewriteList(b.List); err != nil {
+		return err
+	}
+	if err := cv.rewriteList(b.ElseList); err != nil {
+		return err
+	}
+	if err := body(b.List, c); err != nil {
+		return err
+	}
+	if c+1 < len(clauses) && !cv.actions[clauses[c+1]].chain {
+		return body(b.ElseList, c+1)
+	}
+	return nil
+}
+
+// counter returns an action counting the span [start, end), or nil if the span is already counted.
+func (cv *pageCover) counter(start, end int) (parse.Node, error) {
+	id := cv.addBlock(start, end)
+	if id < 0 {
+		return nil, nil
+	}
+	return parseAction(fmt.Sprintf("{{tmplCover %d}}", id), cv.funcs())
+}
+
+// isCoverAction reports whether n is a counter inserted by -cover.
+func isCoverAction(n *parse.ActionNode) bool {
+	id, ok := n.Pipe.Cmds[0].Args[0].(*parse.IdentifierNode)
+	return ok && id.Ident == "tmplCover"
+}
+
+// writeCoverProfile adds the counts collected in this run to the profile at path,
+// in the format of go test -coverprofile with mode count.
+func writeCoverProfile(path string) error {
+	blocks, err := readCoverProfile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	merged := map[string]*coverBlock{}
+	for _, b := range blocks {
+		merged[b.key()] = b
+	}
+	coverage.Lock()
+	for k, b := range coverage.blocks {
+		if old, ok := merged[k]; ok {
+			old.count += b.count
+		} else {
+			c := *b
+			merged[k] = &c
+		}
+	}
+	coverage.Unlock()
+	blocks = blocks[:0]
+	for _, b := range merged {
+		blocks = append(blocks, b)
+	}
+	sortCoverBlocks(blocks)
+
+	var sb strings.Builder
+	sb.WriteString("mode: count\n")
+	for _, b := range blocks {
+		fmt.Fprintf(&sb, "%s 1 %d\n", b.key(), b.count)
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+func sortCoverBlocks(blocks []*coverBlock) {
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		if a.startLine != b.startLine {
+			return a.startLine < b.startLine
+		}
+		if a.startCol != b.startCol {
+			return a.startCol < b.startCol
+		}
+		if a.endLine != b.endLine {
+			return a.endLine < b.endLine
+		}
+		return a.endCol < b.endCol
+	})
+}
+
+// readCoverProfile reads a profile written by writeCoverProfile.
+func readCoverProfile(path string) ([]*coverBlock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var blocks []*coverBlock
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if n == 1 && strings.HasPrefix(line, "mode:") || line == "" {
+			continue
+		}
+		b, err := parseCoverLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, s.Err()
+}
+
+// parseCoverLine parses a profile line such as "a.tmpl:1.3,2.10 1 4".
+func parseCoverLine(line string) (*coverBlock, error) {
+	fields := strings.Fields(line)
+	bad := fmt.Errorf("malformed profile line %q", line)
+	if len(fields) != 3 {
+		return nil, bad
+	}
+	i := strings.LastIndexByte(fields[0], ':')
+	if i < 0 {
+		return nil, bad
+	}
+	b := &coverBlock{file: fields[0][:i]}
+	if _, err := fmt.Sscanf(fields[0][i+1:], "%d.%d,%d.%d", &b.startLine, &b.startCol, &b.endLine, &b.endCol); err != nil {
+		return nil, bad
+	}
+	count, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, bad
+	}
+	b.count = count
+	return b, nil
+}
+
+// runCover implements the cover subcommand, which reports on a profile written by -cover.
+func runCover(args []string) int {
+	fs := flag.NewFlagSet("cover", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpl cover -func=profile | -html=profile [-o file]\n\nReports on a coverage profile written by tmpl -cover.\n\n")
+		fs.PrintDefaults()
+	}
+	funcProfile := fs.String("func", "", "Print the coverage of each template file in profile")
+	htmlProfile := fs.String("html", "", "Write an HTML page showing the template sources annotated with the coverage in profile")
+	out := fs.String("o", "-", "Output file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*funcProfile == "") == (*htmlProfile == "") {
+		fs.Usage()
+		return 2
+	}
+	w, err := getOutput(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl cover:", err)
+		return 1
+	}
+	if c, ok := w.(io.Closer); ok && w != os.Stdout {
+		defer c.Close()
+	}
+	if *funcProfile != "" {
+		err = coverFunc(w, *funcProfile)
+	} else {
+		err = coverHTML(w, *htmlProfile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl cover:", err)
+		return 1
+	}
+	return 0
+}
+
+// coverFiles groups blocks by file, in file order.
+func coverFiles(blocks []*coverBlock) ([]string, map[string][]*coverBlock) {
+	sortCoverBlocks(blocks)
+	var files []string
+	byFile := map[string][]*coverBlock{}
+	for _, b := range blocks {
+		if _, ok := byFile[b.file]; !ok {
+			files = append(files, b.file)
+		}
+		byFile[b.file] = append(byFile[b.file], b)
+	}
+	return files, byFile
+}
+
+func coveredPercent(blocks []*coverBlock) float64 {
+	covered := 0
+	for _, b := range blocks {
+		if b.count > 0 {
+			covered++
+		}
+	}
+	if len(blocks) == 0 {
+		return 100
+	}
+	return 100 * float64(covered) / float64(len(blocks))
+}
+
+func coverFunc(w io.Writer, profile string) error {
+	blocks, err := readCoverProfile(profile)
+	if err != nil {
+		return err
+	}
+	files, byFile := coverFiles(blocks)
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%.1f%%\n", f, coveredPercent(byFile[f]))
+	}
+	_, err = fmt.Fprintf(w, "total\t%.1f%%\n", coveredPercent(blocks))
+	return err
+}
+
+func coverHTML(w io.Writer, profile string) error {
+	blocks, err := readCoverProfile(profile)
+	if err != nil {
+		return err
+	}
+	files, byFile := coverFiles(blocks)
+	var b strings.Builder
+	b.WriteString(coverHTMLHeader)
+	b.WriteString(`<select id="files" onchange="show(this.value)">`)
+	for i, f := range files {
+		fmt.Fprintf(&b, `<option value="file%d">%s (%.1f%%)</option>`, i, html.EscapeString(f), coveredPercent(byFile[f]))
+	}
+	b.WriteString(`</select> <span class="cov0">not covered</span> <span class="cov1">covered</span></div>`)
+	for i, f := range files {
+		display := "none"
+		if i == 0 {
+			display = "block"
+		}
+		fmt.Fprintf(&b, `<pre class="file" id="file%d" style="display: %s">`, i, display)
+		// Templates read from an archive or stdin have no file to show.
+		if src, err := os.ReadFile(f); err != nil {
+			b.WriteString(html.EscapeString(fmt.Sprintf("source not available: %v", err)))
+		} else {
+			b.WriteString(annotateCoverage(string(src), byFile[f]))
+		}
+		b.WriteString("</pre>\n")
+	}
+	b.WriteString(coverHTMLFooter)
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// annotateCoverage returns src as HTML with each block wrapped in a span
+// colored by whether it executed. Inner blocks take precedence over the blocks containing them.
+func annotateCoverage(src string, blocks []*coverBlock) string {
+	lineStart := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lineStart = append(lineStart, i+1)
+		}
+	}
+	offset := func(line, col int) int {
+		if line-1 >= len(lineStart) {
+			return len(src)
+		}
+		return min(lineStart[line-1]+col-1, len(src))
+	}
+	// state[i] is 0 for bytes outside any block, 1 for uncovered and 2 for covered bytes.
+	state := make([]byte, len(src))
+	sorted := append([]*coverBlock(nil), blocks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		return offset(a.endLine, a.endCol)-offset(a.startLine, a.startCol) > offset(b.endLine, b.endCol)-offset(b.startLine, b.startCol)
+	})
+	for _, bl := range sorted {
+		s := byte(1)
+		if bl.count > 0 {
+			s = 2
+		}
+		for i := offset(bl.startLine, bl.startCol); i < offset(bl.endLine, bl.endCol); i++ {
+			state[i] = s
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(src); {
+		j := i
+		for j < len(src) && state[j] == state[i] {
+			j++
+		}
+		text := html.EscapeString(src[i:j])
+		if state[i] == 0 {
+			b.WriteString(text)
+		} else {
+			fmt.Fprintf(&b, `<span class="cov%d">%s</span>`, state[i]-1, text)
+		}
+		i = j
+	}
+	return b.String()
+}
+
+const coverHTMLHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tmpl coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); font-family: Menlo, monospace; }
+#topbar { background: black; position: fixed; top: 0; left: 0; right: 0; padding: 10px; border-bottom: 1px solid rgb(80, 80, 80); }
+pre.file { margin-top: 50px; }
+.cov0 { color: rgb(192, 0, 0); }
+.cov1 { color: rgb(44, 212, 149); }
+</style>
+</head>
+<body>
+<div id="topbar">
+`
+
+const coverHTMLFooter = `<script>
+function show(id) {
+	for (const el of document.querySelectorAll("pre.file")) {
+		el.style.display = el.id == id ? "block" : "none";
+	}
+}
+</script>
+</body>
+</html>
+`
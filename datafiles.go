@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dirDataName is the name of the data file merged into the context of every
+// template in its directory and below.
+const dirDataName = "_data.yaml"
+
+// sidecarSuffix is appended to a template's name to form the name of its sidecar
+// data file, e.g. app.conf.tmpl.yaml for app.conf.tmpl.
+const sidecarSuffix = ".yaml"
+
+// dataFiles loads the data files that apply to templates under root in -r mode.
+// Values from deeper directories override shallower ones, and sidecars override both.
+type dataFiles struct {
+	tree sourceTree
+	root string
+	dirs map[string]map[string]any
+}
+
+func newDataFiles(root string) *dataFiles {
+	return newTreeDataFiles(osTree{}, root)
+}
+
+func newTreeDataFiles(tree sourceTree, root string) *dataFiles {
+	return &dataFiles{tree: tree, root: filepath.Clean(root), dirs: map[string]map[string]any{}}
+}
+
+// isDataFile reports whether path is a data file rather than a template.
+// A file is a sidecar only if the template it belongs to exists.
+func (d *dataFiles) isDataFile(path string) bool {
+	if filepath.Base(path) == dirDataName {
+		return true
+	}
+	tmpl, ok := strings.CutSuffix(path, sidecarSuffix)
+	if !ok {
+		return false
+	}
+	info, err := d.tree.stat(tmpl)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// context returns ctx with the data files that apply to the template at path merged in.
+func (d *dataFiles) context(path string, ctx any) (any, error) {
+	vals := map[string]any{}
+	rel, err := filepath.Rel(d.root, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{d.root}
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], part))
+		}
+	}
+	for _, dir := range dirs {
+		v, err := d.dir(dir)
+		if err != nil {
+			return nil, err
+		}
+		mergeValues(vals, v)
+	}
+	sidecar, err := loadTreeData(d.tree, path+sidecarSuffix)
+	if err != nil {
+		return nil, err
+	}
+	mergeValues(vals, sidecar)
+	if len(vals) == 0 {
+		return ctx, nil
+	}
+	return withValues(ctx, vals)
+}
+
+func (d *dataFiles) dir(dir string) (map[string]any, error) {
+	if v, ok := d.dirs[dir]; ok {
+		return v, nil
+	}
+	v, err := loadTreeData(d.tree, filepath.Join(dir, dirDataName))
+	if err != nil {
+		return nil, err
+	}
+	d.dirs[dir] = v
+	return v, nil
+}
+
+// loadData reads a YAML mapping from path. A missing file yields no values.
+func loadData(path string) (map[string]any, error) {
+	return loadTreeData(osTree{}, path)
+}
+
+// loadTreeData reads a YAML mapping from path in tree. A missing file yields no values.
+func loadTreeData(tree sourceTree, path string) (map[string]any, error) {
+	r, _, err := tree.open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envsubst expands shell-style variable references in src using values from ctx:
+//
+//	$VAR, ${VAR}     value of VAR, empty if unset
+//	${VAR-word}      word if VAR is unset; ${VAR:-word} also if it is empty
+//	${VAR+word}      word if VAR is set; ${VAR:+word} only if it is also non-empty
+//	${VAR?msg}       fail with msg if VAR is unset; ${VAR:?msg} also if it is empty
+//	$$               a literal $
+//
+// Words are expanded recursively. If allowed is non-nil, references to other
+// variables are left untouched, like the SHELL-FORMAT argument of GNU envsubst.
+func envsubst(src string, ctx any, allowed map[string]bool) (string, error) {
+	out, pos, err := substVars(src, ctx, allowed)
+	if err != nil {
+		line := strings.Count(src[:pos], "\n") + 1
+		return "", fmt.Errorf("envsubst: line %d: %w", line, err)
+	}
+	return out, nil
+}
+
+// substVars implements envsubst. On error it also returns the offset of the failing reference in src.
+func substVars(src string, ctx any, allowed map[string]bool) (string, int, error) {
+	var b strings.Builder
+	pos := 0
+	for {
+		i := strings.IndexByte(src[pos:], '$')
+		if i < 0 {
+			b.WriteString(src[pos:])
+			return b.String(), 0, nil
+		}
+		b.WriteString(src[pos : pos+i])
+		pos += i
+		ref, n, err := parseVarRef(src[pos:])
+		if err != nil {
+			return "", pos, err
+		}
+		switch {
+		case n == 0:
+			b.WriteByte('$')
+			n = 1
+		case ref.name == "$":
+			b.WriteByte('$')
+		case allowed != nil && !allowed[ref.name]:
+			b.WriteString(src[pos : pos+n])
+		default:
+			v, err := ref.expand(ctx, allowed)
+			if err != nil {
+				return "", pos, err
+			}
+			b.WriteString(v)
+		}
+		pos += n
+	}
+}
+
+// varRef is a parsed variable reference.
+type varRef struct {
+	name string
+	op   string // "", "-", ":-", "+", ":+", "?" or ":?"
+	word string
+}
+
+// parseVarRef parses the reference at the start of s, which begins with '$'.
+// It returns the number of bytes consumed, or 0 if s does not start with a reference.
+func parseVarRef(s string) (varRef, int, error) {
+	if len(s) < 2 {
+		return varRef{}, 0, nil
+	}
+	if s[1] == '$' {
+		return varRef{name: "$"}, 2, nil
+	}
+	if s[1] != '{' {
+		n := varNameLen(s[1:])
+		if n == 0 {
+			return varRef{}, 0, nil
+		}
+		return varRef{name: s[1 : 1+n]}, 1 + n, nil
+	}
+	end := matchingBrace(s[1:])
+	if end < 0 {
+		return varRef{}, 0, fmt.Errorf("unterminated %q", s[:min(len(s), 20)])
+	}
+	inner := s[2 : 1+end]
+	n := varNameLen(inner)
+	if n == 0 {
+		return varRef{}, 0, fmt.Errorf("bad substitution %q", s[:2+end])
+	}
+	ref := varRef{name: inner[:n]}
+	rest := inner[n:]
+	if rest != "" {
+		for _, op := range []string{":-", ":+", ":?", "-", "+", "?"} {
+			if strings.HasPrefix(rest, op) {
+				ref.op, ref.word = op, rest[len(op):]
+				break
+			}
+		}
+		if ref.op == "" {
+			return varRef{}, 0, fmt.Errorf("bad substitution %q", s[:2+end])
+		}
+	}
+	return ref, 2 + end, nil
+}
+
+// expand returns the value of the reference.
+func (r varRef) expand(ctx any, allowed map[string]bool) (string, error) {
+	v, set := lookupVar(ctx, r.name)
+	empty := !set || (strings.HasPrefix(r.op, ":") && v == "")
+	switch strings.TrimPrefix(r.op, ":") {
+	case "":
+		if !set && *flagMissingKey == "error" {
+			return "", fmt.Errorf("%s is not set", r.name)
+		}
+		return v, nil
+	case "-":
+		if empty {
+			return r.expandWord(ctx, allowed)
+		}
+		return v, nil
+	case "+":
+		if empty {
+			return "", nil
+		}
+		return r.expandWord(ctx, allowed)
+	default: // "?"
+		if !empty {
+			return v, nil
+		}
+		msg, err := r.expandWord(ctx, allowed)
+		if err != nil {
+			return "", err
+		}
+		if msg == "" {
+			msg = "parameter null or not set"
+		}
+		return "", fmt.Errorf("%s: %s", r.name, msg)
+	}
+}
+
+func (r varRef) expandWord(ctx any, allowed map[string]bool) (string, error) {
+	w, _, err := substVars(r.word, ctx, allowed)
+	return w, err
+}
+
+// lookupVar returns the value of name in ctx, which must be a map with string keys.
+func lookupVar(ctx any, name string) (string, bool) {
+	switch c := ctx.(type) {
+	case map[string]string:
+		v, ok := c[name]
+		return v, ok
+	case map[string]any:
+		v, ok := c[name]
+		if !ok || v == nil {
+			return "", ok
+		}
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// parseShellFormat returns the set of variables referenced in format, such as "$FOO ${BAR}".
+// An empty format allows every variable and yields nil.
+func parseShellFormat(format string) (map[string]bool, error) {
+	if strings.TrimSpace(format) == "" {
+		return nil, nil
+	}
+	allowed := map[string]bool{}
+	for {
+		i := strings.IndexByte(format, '$')
+		if i < 0 {
+			return allowed, nil
+		}
+		format = format[i:]
+		ref, n, err := parseVarRef(format)
+		if err != nil {
+			return nil, fmt.Errorf("shell format: %w", err)
+		}
+		if n == 0 {
+			n = 1
+		} else if ref.name != "$" {
+			allowed[ref.name] = true
+		}
+		format = format[n:]
+	}
+}
+
+// varNameLen returns the length of the shell variable name at the start of s.
+func varNameLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// matchingBrace returns the index of the '}' closing the '{' at the start of s, or -1.
+func matchingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// templateErrorRE matches the location prefix of text/template and html/template
+// parse and execution errors, such as
+// `template: name:3:14: executing "name" at <.x>: ...`.
+var templateErrorRE = regexp.MustCompile(`(?:html/)?template: ?(.*?):(\d+)(?::(\d+))?: (.*)`)
+
+// templateError is a parse or execution error located in a template file.
+type templateError struct {
+	file string
+	line int // 1-based
+	col  int // 0-based byte offset, or -1 if unknown
+	msg  string
+	src  string // the offending source line
+	hint string
+	err  error
+}
+
+func (e *templateError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d", e.file, e.line)
+	if e.col >= 0 {
+		fmt.Fprintf(&b, ":%d", e.col+1)
+	}
+	fmt.Fprintf(&b, ": %s", e.msg)
+	if e.src != "" {
+		gutter := fmt.Sprintf("%5d | ", e.line)
+		fmt.Fprintf(&b, "\n%s%s", gutter, strings.ReplaceAll(e.src, "\t", " "))
+		if e.col >= 0 && e.col <= len(e.src) {
+			fmt.Fprintf(&b, "\n%s|%s^", strings.Repeat(" ", len(gutter)-2), strings.Repeat(" ", e.col+1))
+		}
+	}
+	if e.hint != "" {
+		fmt.Fprintf(&b, "\nhint: %s", e.hint)
+	}
+	return b.String()
+}
+
+func (e *templateError) Unwrap() error { return e.err }
+
+// annotate turns a text/template or html/template error from executing the page
+// into a templateError naming the page's file, with the offending line of the
+// original source and a hint for common mistakes. shifts are those of the source
+// as parsed, from stripBlocksShifts. Errors that carry no location are prefixed with the file name.
+func (p *page) annotate(err error, shifts map[int]int) error {
+	if err == nil || errors.As(err, new(*templateError)) {
+		return err
+	}
+	m := templateErrorRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("%s: %w", p.displayName(), err)
+	}
+	line, _ := strconv.Atoi(m[2])
+	col := -1
+	if m[3] != "" {
+		col, _ = strconv.Atoi(m[3])
+	}
+	e := &templateError{
+		file: p.displayName(),
+		line: line + p.offset,
+		col:  col,
+		msg:  m[4],
+		hint: errorHint(m[4]),
+		err:  err,
+	}
+	if col >= 0 {
+		e.col -= shifts[line] + chainOffset(m[4])
+	}
+	e.src = nthLine(p.body, line)
+	return e
+}
+
+// chainOffset returns how far past the start of the node an execution error names
+// text/template reports its column. For a chain such as .A.B or $x.A, the parser
+// records the position after the first name.
+func chainOffset(msg string) int {
+	m := errorNodeRE.FindStringSubmatch(msg)
+	if m == nil || (m[1][0] != '.' && m[1][0] != '$') {
+		return 0
+	}
+	if i := strings.IndexByte(m[1][1:], '.'); i >= 0 {
+		return i + 1
+	}
+	return 0
+}
+
+// displayName returns the name used for the page in errors.
+func (p *page) displayName() string {
+	if p.name == "" || p.name == "-" {
+		return "<stdin>"
+	}
+	return p.name
+}
+
+// nthLine returns the 1-based nth line of s, or "" if there is none.
+func nthLine(s string, n int) string {
+	for i := 1; i < n; i++ {
+		j := strings.IndexByte(s, '\n')
+		if j < 0 {
+			return ""
+		}
+		s = s[j+1:]
+	}
+	if j := strings.IndexByte(s, '\n'); j >= 0 {
+		s = s[:j]
+	}
+	return strings.TrimSuffix(s, "\r")
+}
+
+var (
+	errorNodeRE     = regexp.MustCompile(`^executing ".*?" at <([^>]+)>`)
+	undefinedFuncRE = regexp.MustCompile(`function "([^"]+)" not defined`)
+	noFieldRE       = regexp.MustCompile(`can't evaluate field (\S+) in type (.+)`)
+	callingRE       = regexp.MustCompile(`(?:error calling|wrong type for value; expected \S+; got \S+|wrong number of args for) (\w+)`)
+)
+
+// errorHint explains common causes of a template error message.
+func errorHint(msg string) string {
+	switch {
+	case undefinedFuncRE.MatchString(msg):
+		name := undefinedFuncRE.FindStringSubmatch(msg)[1]
+		if s := suggestFuncs(name); len(s) > 0 {
+			return fmt.Sprintf("did you mean %s?", strings.Join(s, " or "))
+		}
+		return "see https://masterminds.github.io/sprig/ for the available functions"
+	case strings.Contains(msg, "nil pointer evaluating"):
+		return "a value in the chain is missing or nil; guard optional values with with, default or dig"
+	case strings.Contains(msg, "map has no entry for key"):
+		return "the key is not set (-missingkey=error); set it in the environment or data, or use default"
+	case noFieldRE.MatchString(msg):
+		m := noFieldRE.FindStringSubmatch(msg)
+		return fmt.Sprintf("the value has type %s, which has no field %s; inside range and with, . is the current element, use $ to reach the top level", m[2], m[1])
+	case strings.Contains(msg, "wrong type for value") || strings.Contains(msg, "wrong number of args") || strings.Contains(msg, "; found "):
+		name := "the function"
+		if m := callingRE.FindStringSubmatch(msg); m != nil {
+			name = m[1]
+		}
+		return fmt.Sprintf("check the arguments passed to %s; in a pipeline the piped value is passed as the last argument", name)
+	}
+	return ""
+}
+
+// suggestFuncs returns up to three known function names close to name.
+func suggestFuncs(name string) []string {
+	type match struct {
+		name string
+		dist int
+	}
+	var matches []match
+	lower := strings.ToLower(name)
+	for _, known := range knownFuncs() {
+		d := editDistance(lower, strings.ToLower(known))
+		if d <= max(1, len(name)/3) || strings.ToLower(strings.ReplaceAll(known, "_", "")) == strings.ReplaceAll(lower, "_", "") {
+			matches = append(matches, match{known, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+	var result []string
+	for i := 0; i < len(matches) && i < 3; i++ {
+		result = append(result, strconv.Quote(matches[i].name))
+	}
+	return result
+}
+
+// builtinFuncs are the functions predefined by text/template.
+var builtinFuncs = []string{
+	"and", "call", "html", "index", "slice", "js", "len", "not", "or",
+	"print", "printf", "println", "urlquery", "eq", "ge", "gt", "le", "lt", "ne",
+}
+
+// knownFuncs returns the names of every function available to a template, sorted.
+func knownFuncs() []string {
+	seen := map[string]bool{}
+	for _, m := range []map[string]any{txtFuncMap(), fileFuncs(false), new(components).funcs(false)} {
+		for name := range m {
+			seen[name] = true
+		}
+	}
+	for _, name := range builtinFuncs {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
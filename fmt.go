@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// runFmt implements the fmt subcommand and returns the exit code.
+func runFmt(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpl fmt [flags] [path...]\n\nFormats templates. With no path, formats stdin to stdout.\n\n")
+		fs.PrintDefaults()
+	}
+	list := fs.Bool("l", false, "List files whose formatting differs")
+	diff := fs.Bool("d", false, "Print diffs instead of rewriting files")
+	write := fs.Bool("w", false, "Write the result to the source file instead of stdout")
+	lstrip := fs.Bool("lstripblocks", false, "If true, also re-indent block actions without a left trim marker, as rendered with -lstripblocks")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		if *write || *list {
+			fmt.Fprintln(os.Stderr, "tmpl fmt: cannot use -l or -w with stdin")
+			return 2
+		}
+		in, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			err = fmtFile("<stdin>", in, false, *diff, false, *lstrip)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tmpl fmt:", err)
+			return 1
+		}
+		return 0
+	}
+
+	code := 0
+	for _, root := range fs.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := fmtFile(path, b, *list, *diff, *write, *lstrip); err != nil {
+				fmt.Fprintln(os.Stderr, "tmpl fmt:", err)
+				code = 1
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tmpl fmt:", err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// fmtFile formats one file and reports the result according to the -l, -d and -w modes.
+func fmtFile(path string, src []byte, list, diff, write, lstrip bool) error {
+	out, err := formatTemplate(string(src), lstrip)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if out == string(src) {
+		if !list && !diff && !write {
+			_, err = os.Stdout.WriteString(out)
+		}
+		return err
+	}
+	if list {
+		fmt.Println(path)
+	}
+	if diff {
+		io.WriteString(os.Stdout, unifiedDiff(path, string(src), out))
+	}
+	if write {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(out), info.Mode().Perm())
+	}
+	if !list && !diff {
+		_, err = os.Stdout.WriteString(out)
+	}
+	return err
+}
+
+// formatTemplate returns src in canonical form:
+//
+//   - actions are written as {{ x }}, {{- x }} and {{ x -}}, with single spaces between
+//     arguments and around | and :=
+//   - comments and the text between actions are left untouched
+//   - lines that start with a left-trimmed action (and, with lstrip, any block action)
+//     are indented two spaces per enclosing block, since that indentation never reaches the output
+//
+// Front matter is preserved. The result is checked to parse to the same tree as src.
+func formatTemplate(src string, lstrip bool) (string, error) {
+	p, err := parsePage(src)
+	if err != nil {
+		return "", err
+	}
+	left, right := p.delims()
+	prefix := src[:len(src)-len(p.body)]
+	out := reindentActions(formatActions(p.body, left, right), left, right, lstrip)
+
+	want, err := parseTreeString(p.body, left, right, lstrip)
+	if err != nil {
+		return "", err
+	}
+	if got, err := parseTreeString(out, left, right, lstrip); err != nil || got != want {
+		return "", fmt.Errorf("formatting would change the template; please report this as a bug")
+	}
+	return prefix + out, nil
+}
+
+// parseTreeString parses src and returns a canonical string of its templates.
+func parseTreeString(src, left, right string, lstrip bool) (string, error) {
+	src = stripBlocks(src, left, right, false, lstrip)
+	t := parse.New("fmt")
+	t.Mode = parse.ParseComments | parse.SkipFuncCheck
+	trees := map[string]*parse.Tree{}
+	if _, err := t.Parse(src, left, right, trees); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%q:%s\n", name, trees[name].Root.String())
+	}
+	return b.String(), nil
+}
+
+// formatActions rewrites every action in src in canonical form.
+func formatActions(src, left, right string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(src, left)
+		if i < 0 {
+			b.WriteString(src)
+			return b.String()
+		}
+		n := actionEnd(src[i:], left, right)
+		if n < 0 {
+			b.WriteString(src)
+			return b.String()
+		}
+		b.WriteString(src[:i])
+		b.WriteString(formatAction(src[i:i+n], left, right))
+		src = src[i+n:]
+	}
+}
+
+// formatAction returns a single action in canonical form.
+func formatAction(action, left, right string) string {
+	inner := action[len(left) : len(action)-len(right)]
+	ltrim := len(inner) > 1 && inner[0] == '-' && isSpace(inner[1])
+	if ltrim {
+		inner = inner[1:]
+	}
+	rtrim := len(inner) > 1 && inner[len(inner)-1] == '-' && isSpace(inner[len(inner)-2])
+	if rtrim {
+		inner = inner[:len(inner)-1]
+	}
+	body := strings.TrimSpace(inner)
+	if body == "" {
+		return action
+	}
+	if strings.HasPrefix(body, "/*") {
+		if !ltrim && !rtrim {
+			return action // a comment must touch the delimiters
+		}
+	} else {
+		toks, ok := actionTokens(body)
+		if !ok {
+			return action
+		}
+		body = joinTokens(toks)
+	}
+	var b strings.Builder
+	b.WriteString(left)
+	if ltrim {
+		b.WriteString("- ")
+	} else if !strings.HasPrefix(body, "/*") {
+		b.WriteString(" ")
+	}
+	b.WriteString(body)
+	if rtrim {
+		b.WriteString(" -")
+	} else if !strings.HasPrefix(body, "/*") {
+		b.WriteString(" ")
+	}
+	b.WriteString(right)
+	return b.String()
+}
+
+// actionToken is a lexical element of an action.
+type actionToken struct {
+	text string
+	glue bool // written without a preceding space, as in (f .x).Field
+}
+
+// actionTokens splits the body of an action into tokens. It reports false
+// for input it does not understand, such as an unterminated string.
+func actionTokens(s string) ([]actionToken, bool) {
+	var toks []actionToken
+	glue := false
+	for i := 0; i < len(s); {
+		c := s[i]
+		j := i + 1
+		switch {
+		case isSpace(c):
+			i, glue = j, false
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, false
+			}
+			j++
+		case c == '(' || c == ')' || c == '|' || c == ',' || c == '=':
+		case c == ':' && strings.HasPrefix(s[i:], ":="):
+			j++
+		default:
+			for j < len(s) && !isSpace(s[j]) && !strings.ContainsRune("()|,=\"'`", rune(s[j])) && !strings.HasPrefix(s[j:], ":=") {
+				j++
+			}
+		}
+		toks = append(toks, actionToken{s[i:j], glue && len(toks) > 0 && toks[len(toks)-1].text == ")" && s[i] == '.'})
+		i, glue = j, true
+	}
+	return toks, true
+}
+
+func joinTokens(toks []actionToken) string {
+	var b strings.Builder
+	for i, t := range toks {
+		if i > 0 && !t.glue && toks[i-1].text != "(" && t.text != ")" && t.text != "," {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\r' || c == '\n' }
+
+// blockOpeners and blockClosers change the indentation depth in reindentActions.
+var (
+	blockOpeners = map[string]bool{"if": true, "range": true, "with": true, "define": true, "block": true, "file": true, "component": true, "fill": true}
+	blockClosers = map[string]bool{"end": true, "endfile": true, "endcomponent": true, "endfill": true}
+)
+
+// reindentActions indents lines whose leading whitespace is removed by the template
+// anyway: those starting with a left-trimmed action, or with lstrip any block action.
+func reindentActions(src, left, right string, lstrip bool) string {
+	lines := strings.SplitAfter(src, "\n")
+	depth := 0
+	for i, line := range lines {
+		body := strings.TrimLeft(line, " \t")
+		first := true
+		for s := line; ; {
+			j := strings.Index(s, left)
+			if j < 0 {
+				break
+			}
+			n := actionEnd(s[j:], left, right)
+			if n < 0 {
+				break
+			}
+			action := s[j : j+n]
+			word := actionKeyword(action, left, right)
+			if blockClosers[word] || word == "else" {
+				depth = max(0, depth-1)
+			}
+			if first && j == len(line)-len(body) {
+				if strings.HasPrefix(action, left+"- ") || lstrip && isBlockAction(action, left, right) {
+					lines[i] = strings.Repeat("  ", depth) + body
+				}
+			}
+			if blockOpeners[word] || word == "else" {
+				depth++
+			}
+			first = false
+			s = s[j+n:]
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// actionKeyword returns the first word of an action.
+func actionKeyword(action, left, right string) string {
+	inner := strings.TrimSuffix(strings.TrimPrefix(action, left), right)
+	inner = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(inner), "- "))
+	if i := strings.IndexAny(inner, " \t\r\n("); i >= 0 {
+		inner = inner[:i]
+	}
+	return inner
+}
+
+// unifiedDiff returns a unified diff between a and b with three lines of context.
+func unifiedDiff(name, a, b string) string {
+	x, y := splitLines(a), splitLines(b)
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // line numbers in x and y before this edit
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", name, name)
+	const context = 3
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := max(0, k-context)
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end = min(run, end+context)
+				break
+			}
+			end = run
+		}
+		var na, nb int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				na++
+			}
+			if e.op != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", edits[start].i+1, na, edits[start].j+1, nb)
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return out.String()
+}
+
+// splitLines splits s after each newline, without a trailing empty line.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatter holds the per-file options a template can set in a leading YAML block:
+//
+//	--- # tmpl
+//	output: "{{ .name }}.yaml"
+//	mode: 0600
+//	skip: '{{ eq .ENV "dev" }}'
+//	delims: ["[[", "]]"]
+//	html: true
+//	data:
+//	  replicas: 3
+//	---
+//
+// The block must start with frontMatterOpener, so that templates of YAML documents
+// starting with "---" are left alone.
+type frontMatter struct {
+	Output string         `yaml:"output"`
+	Mode   any            `yaml:"mode"`
+	Skip   any            `yaml:"skip"`
+	Delims []string       `yaml:"delims"`
+	HTML   *bool          `yaml:"html"`
+	Data   map[string]any `yaml:"data"`
+}
+
+// frontMatterOpener is the first line of a front matter block. It is a YAML document
+// separator followed by a comment.
+const frontMatterOpener = "--- # tmpl\n"
+
+// page is a template with its front matter split off.
+type page struct {
+	frontMatter
+	body   string
+	name   string // file name used in errors; "" or "-" for stdin
+	offset int    // number of front matter lines before body
+}
+
+func readPage(in io.Reader) (*page, error) {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return parsePage(string(b))
+}
+
+// parsePage splits the front matter off src. Errors in a block opened by
+// frontMatterOpener, including unknown keys, are reported rather than rendered as text.
+func parsePage(src string) (*page, error) {
+	p := &page{body: src}
+	rest, ok := strings.CutPrefix(src, frontMatterOpener)
+	if !ok {
+		return p, nil
+	}
+	var fm, body string
+	if after, ok := strings.CutPrefix(rest, "---\n"); ok {
+		body = after
+	} else if i := strings.Index(rest, "\n---\n"); i >= 0 {
+		fm, body = rest[:i+1], rest[i+len("\n---\n"):]
+	} else if strings.HasSuffix(rest, "\n---") {
+		fm = strings.TrimSuffix(rest, "---")
+	} else {
+		return nil, fmt.Errorf("front matter: no closing ---")
+	}
+	// Decoding from the opener keeps the line numbers in errors those of the file.
+	dec := yaml.NewDecoder(strings.NewReader(frontMatterOpener + fm))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p.frontMatter); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("front matter: %w", err)
+	}
+	if d := p.Delims; d != nil && (len(d) != 2 || d[0] == "" || d[1] == "") {
+		return nil, fmt.Errorf("front matter: delims must be a pair of non-empty strings, got %q", d)
+	}
+	p.body = body
+	p.offset = strings.Count(src[:len(src)-len(body)], "\n")
+	return p, nil
+}
+
+// delims returns the action delimiters for the page.
+func (p *page) delims() (string, string) {
+	if p.Delims != nil {
+		return p.Delims[0], p.Delims[1]
+	}
+	return "{{", "}}"
+}
+
+// isHTML reports whether the page is rendered with html/template.
+func (p *page) isHTML(htmlMode bool) bool {
+	if p.HTML != nil {
+		return *p.HTML
+	}
+	return htmlMode
+}
+
+// context returns ctx with the front matter data merged in.
+func (p *page) context(ctx any) (any, error) {
+	if len(p.Data) == 0 {
+		return ctx, nil
+	}
+	return withValues(ctx, p.Data)
+}
+
+// skip reports whether the front matter skip condition holds for ctx.
+func (p *page) skip(ctx any) (bool, error) {
+	switch s := p.Skip.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return s, nil
+	case string:
+		v, err := renderString(s, ctx)
+		if err != nil {
+			return false, fmt.Errorf("front matter: skip: %w", err)
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("front matter: skip: %q is not a boolean", v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("front matter: skip: invalid type %T", s)
+	}
+}
+
+// outputName renders the front matter output path for ctx, or returns "" if none is set.
+func (p *page) outputName(ctx any) (string, error) {
+	if p.Output == "" {
+		return "", nil
+	}
+	name, err := renderString(p.Output, ctx)
+	if err != nil {
+		return "", fmt.Errorf("front matter: output: %w", err)
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("front matter: output: %q is not a local path", name)
+	}
+	return name, nil
+}
+
+// mode returns the front matter file mode, or 0 if none is set.
+func (p *page) mode() (os.FileMode, error) {
+	if p.Mode == nil {
+		return 0, nil
+	}
+	m, err := parseMode(p.Mode)
+	if err != nil {
+		return 0, fmt.Errorf("front matter: %w", err)
+	}
+	return m, nil
+}
+
+// renderString renders a short text template such as a front matter value.
+func renderString(src string, ctx any) (string, error) {
+	t, err := newTxtTemplate("front matter").Parse(src)
+	if err != nil {
+		return "", err
+	}
+	t = t.Option(fmt.Sprintf("missingkey=%s", *flagMissingKey))
+	var b bytes.Buffer
+	err = t.Execute(&b, ctx)
+	return b.String(), err
+}
@@ -0,0 +1,278 @@
+package main
+
+// funcDocs documents the sprig and tmpl functions in one line each, for hover in tmpl lsp.
+// Functions predefined by text/template are documented in builtinDocs.
+var funcDocs = map[string]string{
+	// Strings.
+	"abbrev":       "Truncates a string to the given width, adding an ellipsis: abbrev 5 \"hello world\" is \"he...\".",
+	"abbrevboth":   "Keeps the given numbers of bytes at the start and end of a string, with an ellipsis between: abbrevboth 2 3 \"hello world\" is \"he...rld\".",
+	"camelcase":    "Converts a string to CamelCase, starting a word at each non-alphanumeric character: camelcase \"http_server\" is \"HttpServer\".",
+	"cat":          "Concatenates its arguments formatted with %v, without separators.",
+	"contains":     "Reports whether the first string contains the second: contains .S \"cat\".",
+	"hasPrefix":    "Reports whether the second string starts with the first.",
+	"hasSuffix":    "Reports whether the second string ends with the first.",
+	"indent":       "Indents every line of a string by the given number of spaces.",
+	"initials":     "Returns the first letter of each word in a string, in upper case.",
+	"kebabcase":    "Converts a string from camelCase to kebab-case.",
+	"lower":        "Converts a string to lower case.",
+	"nindent":      "Like indent, but starts with a newline.",
+	"nospace":      "Removes all whitespace from a string.",
+	"plural":       "Returns the first string if the count is 1 and the second otherwise: plural \"one\" \"many\" .N.",
+	"quote":        "Wraps a string in double quotes, escaping as Go does.",
+	"randAlpha":    "Returns a string of the given length made of letters; this build repeats \"abcde\" instead of choosing at random.",
+	"randAlphaNum": "Returns a string of the given length made of letters and digits; this build repeats \"abcde\" instead of choosing at random.",
+	"randAscii":    "Returns a string of the given length made of printable ASCII characters; this build repeats \"abcde\" instead of choosing at random.",
+	"randNumeric":  "Returns a string of the given length made of digits; this build repeats \"12345\" instead of choosing at random.",
+	"repeat":       "Repeats a string the given number of times: repeat 3 \"ab\".",
+	"replace":      "Replaces occurrences of the second string with the third in the first, at most n times if n is given: replace .S \" \" \"-\".",
+	"shuffle":      "Reverses the characters of a string; this build does not shuffle at random.",
+	"snakecase":    "Converts a string from camelCase to snake_case.",
+	"squote":       "Wraps a string in single quotes, escaping single quotes in it with a backslash.",
+	"substr":       "Returns the part of a string between two byte offsets: substr 0 5 .S. A negative end means the end of the string.",
+	"swapcase":     "Swaps the case of each letter in a string.",
+	"title":        "Capitalizes each word of a string and lower-cases the rest, joining the words with single spaces.",
+	"trim":         "Removes leading and trailing whitespace from a string.",
+	"trimAll":      "Removes the given characters from both ends of a string: trimAll \"$\" .S.",
+	"trimall":      "Deprecated alias of trimAll.",
+	"trimPrefix":   "Removes a prefix from a string, if present: trimPrefix \"v\" .Version.",
+	"trimSuffix":   "Removes a suffix from a string, if present.",
+	"trunc":        "Truncates a string to the given number of bytes; a negative length gives \"\".",
+	"untitle":      "Converts the first letter of a string to lower case.",
+	"upper":        "Converts a string to upper case.",
+	"wrap":         "Wraps text at the given column.",
+	"wrapWith":     "Wraps text at the given column, using the given string as the line break.",
+
+	// String lists.
+	"join":      "Joins a list into a string with the given separator: join \",\" .List.",
+	"sortAlpha": "Sorts a list of strings in lexical order.",
+	"split":     "Splits a string into a map with keys \"0\", \"1\" and so on: index (split \"$\" .S) \"0\".",
+	"splitList": "Splits a string into a list: splitList \",\" .S.",
+	"splitn":    "Splits a string into at most n parts, as a map with keys \"0\", \"1\" and so on: splitn \"$\" 2 .S.",
+	"toStrings": "Converts each element of a list to a string.",
+
+	// Type conversion.
+	"atoi":      "Converts a string to an integer, returning 0 if it is not one.",
+	"float64":   "Converts a number or numeric string to a float64; other values give 0.",
+	"int":       "Converts a number or decimal string to an int, truncating floats; other values give 0.",
+	"int64":     "Converts a number or decimal string to an int64, truncating floats; other values give 0.",
+	"toDecimal": "Alias of float64, so toDecimal \"0755\" is 755; it does not parse octal.",
+	"toInt":     "Alias of int.",
+	"toString":  "Converts a value to a string.",
+
+	// Math.
+	"add":       "Adds its arguments as integers.",
+	"add1":      "Adds 1 to an integer.",
+	"add1f":     "Adds 1 to a float.",
+	"addf":      "Adds its arguments as floats.",
+	"biggest":   "Deprecated alias of max.",
+	"ceil":      "Returns the smallest integer value not less than a number.",
+	"div":       "Divides two integers; dividing by zero gives 0.",
+	"divf":      "Divides the first argument by each of the others as floats.",
+	"floor":     "Returns the largest integer value not greater than a number.",
+	"max":       "Returns the largest of its integer arguments.",
+	"maxf":      "Returns the largest of its float arguments.",
+	"min":       "Returns the smallest of its integer arguments.",
+	"minf":      "Returns the smallest of its float arguments.",
+	"mod":       "Returns the remainder of dividing two integers; dividing by zero gives 0.",
+	"mul":       "Multiplies its arguments as integers.",
+	"mulf":      "Multiplies its arguments as floats.",
+	"round":     "Rounds a number to the nearest integer, halves away from zero: round 2.5 is 3.",
+	"seq":       "Returns a sequence of integers like the seq command: seq 5, seq 2 5 or seq 0 2 10.",
+	"sub":       "Subtracts the second integer from the first.",
+	"subf":      "Subtracts the remaining arguments from the first as floats.",
+	"until":     "Returns the integers from 0 up to, but not including, n.",
+	"untilStep": "Returns the integers from start up to, but not including, stop in steps: untilStep 0 10 2.",
+
+	// Dates.
+	"ago":              "Returns the time elapsed since a time, Unix timestamp or RFC 3339 string, as a duration such as 1h2m3.5s.",
+	"date":             "Formats a time or Unix timestamp with a Go layout: date \"2006-01-02\" now.",
+	"dateInZone":       "Like date, in the named time zone: dateInZone \"2006-01-02\" now \"UTC\". An unknown zone gives \"\".",
+	"date_in_zone":     "Deprecated alias of dateInZone.",
+	"dateModify":       "Adds a duration to a time: dateModify \"-1.5h\" now. A bad duration leaves the time unchanged.",
+	"date_modify":      "Deprecated alias of dateModify.",
+	"duration":         "Converts a number of seconds or a duration string to a duration, printed like 1m35s; other values give 0.",
+	"durationRound":    "Rounds a duration to the nearest second.",
+	"htmlDate":         "Formats a time as an HTML date input value, 2006-01-02.",
+	"htmlDateInZone":   "Like htmlDate, in the named time zone.",
+	"mustDateModify":   "Like dateModify, but fails the render on a bad duration.",
+	"must_date_modify": "Deprecated alias of mustDateModify.",
+	"now":              "Returns the current time.",
+	"toDate":           "Converts a time or Unix timestamp to a time; other values, including strings, give the zero time.",
+	"unixEpoch":        "Returns the Unix timestamp of a time in seconds.",
+
+	// Defaults and flow control.
+	"all":      "Reports whether all its arguments are non-empty.",
+	"any":      "Reports whether any of its arguments is non-empty.",
+	"coalesce": "Returns the first non-empty argument.",
+	"default":  "Returns the given value if it is non-empty, and the default otherwise: .Port | default 8080.",
+	"empty":    "Reports whether a value is empty: nil, false, 0, \"\" or an empty collection.",
+	"fail":     "Fails the render with the given message.",
+	"ternary":  "Returns the first value if the condition is non-empty and the second otherwise: ternary \"yes\" \"no\" .OK.",
+
+	// Encoding.
+	"b32dec":       "Decodes a base32 string, returning the error message if it is invalid.",
+	"b32enc":       "Encodes a string as base32.",
+	"b64dec":       "Decodes a base64 string, returning the error message if it is invalid.",
+	"b64enc":       "Encodes a string as base64.",
+	"fromJson":     "Decodes a JSON string, returning \"\" if it is invalid.",
+	"fromYaml":     "Decodes a YAML string, returning \"\" if it is invalid.",
+	"toJson":       "Encodes a value as JSON, or \"\" if it cannot be encoded.",
+	"toPrettyJson": "Encodes a value as JSON indented by two spaces, or \"\" if it cannot be encoded.",
+	"toRawJson":    "Same as toJson; HTML characters are escaped all the same.",
+	"toYaml":       "Encodes a value as YAML, or \"\" if it cannot be encoded.",
+
+	// Lists.
+	"append":  "Returns a list with a value added at the end: append .List \"x\".",
+	"chunk":   "Splits a list into chunks of the given size: chunk 2 .List.",
+	"compact": "Returns a list without its empty values.",
+	"concat":  "Concatenates lists; arguments that are not lists are added as elements.",
+	"first":   "Returns the first element of a list.",
+	"has":     "Reports whether a list contains a value: has \"x\" .List.",
+	"initial": "Returns all but the last element of a list.",
+	"last":    "Returns the last element of a list.",
+	"list":    "Returns a list of its arguments.",
+	"prepend": "Returns a list with a value added at the start.",
+	"push":    "Alias of append.",
+	"rest":    "Returns all but the first element of a list.",
+	"reverse": "Returns a list in reverse order.",
+	"tuple":   "Alias of list.",
+	"uniq":    "Returns a list without duplicate values.",
+	"without": "Returns a list without the given values: without .List \"a\" \"b\".",
+
+	// Dictionaries.
+	"deepCopy":       "Returns a deep copy of a value.",
+	"dict":           "Returns a dictionary of its key and value arguments: dict \"name\" .Name \"port\" 80.",
+	"dig":            "Looks up a dot-separated path of keys in a dictionary, failing the render if a key is missing: dig \"a.b\" .Dict.",
+	"get":            "Returns the value of a key in a dictionary, or \"\" if it is not set.",
+	"hasKey":         "Reports whether a dictionary has a key.",
+	"keys":           "Returns the keys of one or more dictionaries, in no particular order.",
+	"merge":          "Merges dictionaries into the first, later values overwriting earlier ones.",
+	"mergeOverwrite": "Same as merge.",
+	"omit":           "Returns a dictionary without the given keys.",
+	"pick":           "Returns a dictionary with only the given keys.",
+	"pluck":          "Returns the values of a key in each of the given dictionaries.",
+	"set":            "Sets a key in a dictionary and returns the dictionary.",
+	"unset":          "Removes a key from a dictionary and returns the dictionary.",
+	"values":         "Returns the values of a dictionary, in no particular order.",
+
+	// Type inspection and comparison.
+	"deepEqual":  "Reports whether two values are deeply equal.",
+	"kindIs":     "Reports whether a value has the given kind: kindIs \"map\" .V.",
+	"kindOf":     "Returns the kind of a value, such as \"map\" or \"slice\".",
+	"typeIs":     "Reports whether a value has the given Go type: typeIs \"string\" .V.",
+	"typeIsLike": "Reports whether the Go type of a value contains the given string, so typeIsLike \"string\" also matches *string.",
+	"typeOf":     "Returns the Go type of a value.",
+
+	// Paths.
+	"base":    "Returns the last element of a slash-separated path.",
+	"clean":   "Cleans a slash-separated path.",
+	"dir":     "Returns all but the last element of a slash-separated path.",
+	"ext":     "Returns the extension of a slash-separated path.",
+	"isAbs":   "Reports whether a slash-separated path is absolute.",
+	"osBase":  "Like base, for an operating system path.",
+	"osClean": "Like clean, for an operating system path.",
+	"osDir":   "Like dir, for an operating system path.",
+	"osExt":   "Like ext, for an operating system path.",
+	"osIsAbs": "Like isAbs, for an operating system path.",
+
+	// Regular expressions.
+	"regexFind":              "Returns the first match of a regular expression in a string.",
+	"regexFindAll":           "Returns up to n matches of a regular expression in a string; -1 returns all.",
+	"regexMatch":             "Reports whether a string matches a regular expression.",
+	"regexQuoteMeta":         "Escapes the regular expression metacharacters in a string.",
+	"regexReplaceAll":        "Replaces matches of a regular expression, expanding $1 and the like in the replacement.",
+	"regexReplaceAllLiteral": "Replaces matches of a regular expression with a literal string.",
+	"regexSplit":             "Splits a string around matches of a regular expression into at most n parts; -1 returns all.",
+
+	// Semantic versions.
+	"semver":        "Parses a semantic version into a dictionary with Major, Minor, Patch, Prerelease and Metadata, or nil if it is invalid.",
+	"semverCompare": "Reports whether a version satisfies a constraint with one operator such as >=, <, != or ^: semverCompare \">=1.2.0\" .Version.",
+
+	// Cryptography and security.
+	"addPEMHeader":             "Wraps data in PEM BEGIN and END lines of the given type: addPEMHeader \"CERTIFICATE\" .Data.",
+	"adler32sum":               "Returns the Adler-32 checksum of a string, in decimal.",
+	"bcrypt":                   "Returns a hex SHA-256 digest standing in for a bcrypt hash; this build does not implement bcrypt.",
+	"buildCustomCert":          "Returns a dictionary with Cert and Key decoded from the given base64 strings.",
+	"decryptAES":               "Decrypts a base64 string encrypted with encryptAES using the given password, or returns \"\" if it cannot.",
+	"derivePassword":           "Returns 16 hex digits derived with SHA-256 from a counter, password type, password, user and site; this build does not implement the Master Password algorithm.",
+	"encryptAES":               "Encrypts a string with AES-256 CBC keyed by the SHA-256 of the password, as base64 with the IV first.",
+	"genCA":                    "Returns a dictionary with a placeholder Cert and Key; this build does not generate real certificates.",
+	"genCAWithKey":             "Like genCA, with the given key as Key.",
+	"genPrivateKey":            "Returns a placeholder PEM block for a key of type rsa, dsa, ecdsa or ed25519; this build does not generate real keys.",
+	"genSelfSignedCert":        "Returns a dictionary with a placeholder Cert and Key; this build does not generate real certificates.",
+	"genSelfSignedCertWithKey": "Like genSelfSignedCert, with the given key as Key.",
+	"genSignedCert":            "Returns a dictionary with a placeholder Cert and Key; this build does not generate real certificates.",
+	"genSignedCertWithKey":     "Like genSignedCert, with the given key as Key.",
+	"htpasswd":                 "Returns an htpasswd line for a user and password; hash type \"sha\" gives the {SHA} format and others a hex SHA-256 digest.",
+	"md5sum":                   "Returns the hex MD5 digest of a string.",
+	"randBytes":                "Returns a string of the given length; this build repeats \"abcde\" instead of choosing random bytes.",
+	"randInt":                  "Returns min+1 for the given min and max; this build does not choose at random.",
+	"sha1sum":                  "Returns the hex SHA-1 digest of a string.",
+	"sha256sum":                "Returns the hex SHA-256 digest of a string.",
+	"sha512sum":                "Returns the hex SHA-512 digest of a string.",
+	"uuidv4":                   "Returns the fixed UUID 12345678-1234-4234-8234-123456789012; this build does not generate random ones.",
+
+	// URLs, network and environment.
+	"env":           "Returns the value of an environment variable.",
+	"expandenv":     "Replaces $VAR and ${VAR} in a string with environment variables.",
+	"getHostByName": "Returns the first IP address of a host name, or \"\" if it cannot be resolved.",
+	"hello":         "Returns \"Hello!\".",
+	"urlJoin":       "Resolves a URL reference against a base URL: urlJoin \"https://example.com/a/\" \"b\" is \"https://example.com/a/b\".",
+	"urlParse":      "Parses a URL into a dictionary with scheme, host, hostname, port, path, query, fragment and userinfo.",
+
+	// Variants that fail the render instead of returning a zero value.
+	"mustAppend":                 "Same as append, which cannot fail.",
+	"mustAtoi":                   "Like atoi, but fails the render if the string is not an integer.",
+	"mustB32dec":                 "Like b32dec, but fails the render on invalid base32.",
+	"mustB64dec":                 "Like b64dec, but fails the render on invalid base64.",
+	"mustChunk":                  "Same as chunk, which cannot fail.",
+	"mustCompact":                "Like compact, but fails the render if the argument is not a list or has no non-empty values.",
+	"mustDate":                   "Like date, but fails the render on a value that is not a time or Unix timestamp.",
+	"mustDateInZone":             "Like dateInZone, but fails the render on an unknown zone or a value that is not a time or Unix timestamp.",
+	"mustDeepCopy":               "Same as deepCopy, which cannot fail.",
+	"mustDiv":                    "Like div, but fails the render on an error such as division by zero.",
+	"mustDuration":               "Like duration, but fails the render on a value that is not a number of seconds or a duration.",
+	"mustFirst":                  "Like first, but fails the render on an empty list.",
+	"mustFloat64":                "Like float64, but fails the render on a string that is not a number or a value that is not a number.",
+	"mustFromJson":               "Like fromJson, but fails the render on invalid JSON.",
+	"mustFromYaml":               "Like fromYaml, but fails the render on invalid YAML.",
+	"mustHas":                    "Same as has, which cannot fail.",
+	"mustInitial":                "Same as initial, which cannot fail.",
+	"mustInt":                    "Like int, but fails the render on a string that is not an integer or a value that is not a number.",
+	"mustInt64":                  "Like int64, but fails the render on a string that is not an integer or a value that is not a number.",
+	"mustLast":                   "Like last, but fails the render on an empty list.",
+	"mustMerge":                  "Same as merge, which cannot fail.",
+	"mustMergeOverwrite":         "Same as mergeOverwrite, which cannot fail.",
+	"mustMod":                    "Like mod, but fails the render on an error such as division by zero.",
+	"mustPrepend":                "Same as prepend, which cannot fail.",
+	"mustPush":                   "Same as push, which cannot fail.",
+	"mustRegexFind":              "Like regexFind, but fails the render on an invalid expression.",
+	"mustRegexFindAll":           "Like regexFindAll, but fails the render on an invalid expression.",
+	"mustRegexMatch":             "Like regexMatch, but fails the render on an invalid expression.",
+	"mustRegexReplaceAll":        "Like regexReplaceAll, but fails the render on an invalid expression.",
+	"mustRegexReplaceAllLiteral": "Like regexReplaceAllLiteral, but fails the render on an invalid expression.",
+	"mustRegexSplit":             "Like regexSplit, but fails the render on an invalid expression.",
+	"mustRest":                   "Same as rest, which cannot fail.",
+	"mustReverse":                "Same as reverse, which cannot fail.",
+	"mustSemver":                 "Like semver, but fails the render on an invalid version.",
+	"mustSlice":                  "Same as slice, which cannot fail.",
+	"mustToDate":                 "Like toDate, but fails the render on a value that is not a time or Unix timestamp.",
+	"mustToJson":                 "Like toJson, but fails the render on a value that cannot be encoded.",
+	"mustToPrettyJson":           "Like toPrettyJson, but fails the render on a value that cannot be encoded.",
+	"mustToRawJson":              "Like toRawJson, but fails the render on a value that cannot be encoded.",
+	"mustToYaml":                 "Like toYaml, but fails the render on a value that cannot be encoded.",
+	"mustUniq":                   "Same as uniq, which cannot fail.",
+	"mustUrlJoin":                "Like urlJoin, but fails the render on an invalid URL.",
+	"mustUrlParse":               "Like urlParse, but fails the render on an invalid URL.",
+	"mustWithout":                "Same as without, which cannot fail.",
+
+	// tmpl functions.
+	"file":         "Writes what is rendered until the next file or endfile call to the named file, with an optional mode: file \"a.conf\" 0600.",
+	"endfile":      "Switches output back to the template's own output after file.",
+	"component":    "Renders a defined template as a component with the given arguments, up to endcomponent as its body.",
+	"endcomponent": "Ends the body of a component call.",
+	"fill":         "Starts the content of the named slot inside a component call, up to endfill.",
+	"endfill":      "Ends the content of a slot started with fill.",
+	"slot":         "Inside a component, renders the body of the call, or with a name the content of the matching fill.",
+	"param":        "Inside a component, returns the named argument, or the given default; fails the render if it is missing and has no default.",
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// helmChart is a chart directory loaded for rendering with -helm.
+type helmChart struct {
+	dir       string
+	name      string
+	meta      map[string]any
+	values    map[string]any
+	files     helmFiles
+	templates []string // paths relative to dir, sorted
+}
+
+// helmFiles implements .Files: the chart's files outside templates/.
+type helmFiles map[string][]byte
+
+// Get returns the contents of the named file, or "" if it does not exist.
+func (f helmFiles) Get(name string) string { return string(f[name]) }
+
+// GetBytes returns the contents of the named file.
+func (f helmFiles) GetBytes(name string) []byte { return f[name] }
+
+// Glob returns the files whose names match pattern, using path.Match syntax.
+func (f helmFiles) Glob(pattern string) helmFiles {
+	result := helmFiles{}
+	for name, b := range f {
+		if ok, _ := path.Match(pattern, name); ok {
+			result[name] = b
+		}
+	}
+	return result
+}
+
+// Lines returns the lines of the named file.
+func (f helmFiles) Lines(name string) []string {
+	s := strings.TrimSuffix(f.Get(name), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// AsConfig returns the files as the YAML body of a ConfigMap's data.
+func (f helmFiles) AsConfig() string {
+	m := map[string]string{}
+	for name, b := range f {
+		m[path.Base(name)] = string(b)
+	}
+	return helmToYaml(m)
+}
+
+// helmAPIVersions implements .Capabilities.APIVersions. No cluster is consulted, so Has is always false.
+type helmAPIVersions []string
+
+func (helmAPIVersions) Has(string) bool { return false }
+
+// loadHelmChart reads Chart.yaml, values.yaml, -values files, -set overrides and the chart's files.
+func loadHelmChart(dir string) (*helmChart, error) {
+	c := &helmChart{dir: dir, files: helmFiles{}, values: map[string]any{}}
+	b, err := os.ReadFile(filepath.Join(dir, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]any{}
+	if err := yaml.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("Chart.yaml: %w", err)
+	}
+	c.meta = map[string]any{}
+	for k, v := range meta {
+		c.meta[helmFieldName(k)] = v
+	}
+	c.name, _ = meta["name"].(string)
+	if c.name == "" {
+		return nil, fmt.Errorf("Chart.yaml: missing name")
+	}
+
+	for _, path := range append([]string{filepath.Join(dir, "values.yaml")}, *flagHelmValues...) {
+		v, err := loadData(path)
+		if err != nil {
+			return nil, err
+		}
+		mergeValues(c.values, v)
+	}
+	for _, s := range *flagHelmSet {
+		if err := helmSet(c.values, s); err != nil {
+			return nil, err
+		}
+	}
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == "charts" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(rel, "templates/") {
+			c.templates = append(c.templates, rel)
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		c.files[rel] = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(c.templates)
+	return c, nil
+}
+
+// helmFieldName maps a Chart.yaml key to the field name Helm exposes in .Chart.
+func helmFieldName(k string) string {
+	if k == "apiVersion" {
+		return "APIVersion"
+	}
+	r := []rune(k)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// helmSet applies a --set style override such as "a.b=1,c=x" to values.
+func helmSet(values map[string]any, s string) error {
+	for _, assignment := range strings.Split(s, ",") {
+		key, raw, ok := strings.Cut(assignment, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("-set %q: expected key=value", assignment)
+		}
+		var v any = raw
+		switch {
+		case raw == "true" || raw == "false":
+			v = raw == "true"
+		case raw == "null":
+			v = nil
+		default:
+			if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+				v = n
+			}
+		}
+		parts := strings.Split(key, ".")
+		m := values
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = v
+	}
+	return nil
+}
+
+// helmToYaml is Helm's toYaml, which omits the trailing newline.
+func helmToYaml(v any) string {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(b), "\n")
+}
+
+// helmQuote is Helm's quote, which quotes each non-nil argument of any type and joins them with spaces.
+func helmQuote(v ...any) string {
+	var out []string
+	for _, s := range v {
+		if s != nil {
+			out = append(out, strconv.Quote(fmt.Sprint(s)))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// helmSquote is Helm's squote, which single-quotes each non-nil argument of any type.
+func helmSquote(v ...any) string {
+	var out []string
+	for _, s := range v {
+		if s != nil {
+			out = append(out, "'"+fmt.Sprint(s)+"'")
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// helmFuncMap returns the functions Helm adds to sprig, bound to the template set *t.
+func helmFuncMap(t **template.Template) template.FuncMap {
+	return template.FuncMap{
+		"toYaml": helmToYaml,
+		"quote":  helmQuote,
+		"squote": helmSquote,
+		"include": func(name string, data any) (string, error) {
+			var b bytes.Buffer
+			err := (*t).ExecuteTemplate(&b, name, data)
+			return b.String(), err
+		},
+		"tpl": func(src string, data any) (string, error) {
+			clone, err := (*t).Clone()
+			if err != nil {
+				return "", err
+			}
+			tt, err := clone.New("tpl").Parse(src)
+			if err != nil {
+				return "", err
+			}
+			var b bytes.Buffer
+			err = tt.Execute(&b, data)
+			return strings.ReplaceAll(b.String(), "<no value>", ""), err
+		},
+		"required": func(msg string, v any) (any, error) {
+			if v == nil || v == "" {
+				return nil, fmt.Errorf("%s", msg)
+			}
+			return v, nil
+		},
+		"lookup": func(apiVersion, kind, namespace, name string) (map[string]any, error) {
+			return map[string]any{}, nil
+		},
+	}
+}
+
+// render renders every template that is not a partial (_*.tpl) or NOTES.txt,
+// calling emit with the output named chart/templates/... . Empty manifests are skipped.
+func (c *helmChart) render(emit func(renderedFile) error) error {
+	var t *template.Template
+	funcs := helmFuncMap(&t)
+	t = template.New(c.name).Option("missingkey=zero").Funcs(txtFuncMap()).Funcs(funcs)
+	for _, rel := range c.templates {
+		b, err := os.ReadFile(filepath.Join(c.dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		src := stripBlocks(string(b), "{{", "}}", *flagTrimBlocks, *flagLstripBlocks)
+		if _, err := t.New(path.Join(c.name, rel)).Parse(src); err != nil {
+			return err
+		}
+	}
+
+	top := map[string]any{
+		"Values": c.values,
+		"Chart":  c.meta,
+		"Files":  c.files,
+		"Release": map[string]any{
+			"Name":      *flagHelmRelease,
+			"Namespace": *flagHelmNamespace,
+			"Service":   "Helm",
+			"IsInstall": true,
+			"IsUpgrade": false,
+			"Revision":  1,
+		},
+		"Capabilities": map[string]any{
+			"KubeVersion": map[string]any{"Version": "v1.29.0", "GitVersion": "v1.29.0", "Major": "1", "Minor": "29"},
+			"APIVersions": helmAPIVersions{},
+		},
+	}
+	for _, rel := range c.templates {
+		base := path.Base(rel)
+		if strings.HasPrefix(base, "_") || base == "NOTES.txt" {
+			continue
+		}
+		name := path.Join(c.name, rel)
+		top["Template"] = map[string]any{"Name": name, "BasePath": path.Join(c.name, "templates")}
+		var b bytes.Buffer
+		if err := t.ExecuteTemplate(&b, name, top); err != nil {
+			return err
+		}
+		out := strings.ReplaceAll(b.String(), "<no value>", "")
+		if strings.TrimSpace(out) == "" {
+			continue
+		}
+		if err := emit(renderedFile{name: filepath.FromSlash(name), mode: 0644, contents: out}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHelm renders the chart in dir. Manifests are written to stdout as a YAML
+// stream like helm template, or through the -r output pipeline when -w or -txtar is given.
+func runHelm(dir string, outPath string, stripN int, txtarMode bool) error {
+	c, err := loadHelmChart(dir)
+	if err != nil {
+		return fmt.Errorf("helm: %w", err)
+	}
+	if outPath != "-" || txtarMode {
+		return writeOutputs(c.render, outPath, stripN, txtarMode)
+	}
+	return c.render(func(f renderedFile) error {
+		_, err := fmt.Fprintf(os.Stdout, "---\n# Source: %s\n%s", filepath.ToSlash(f.name), f.contents)
+		if err == nil && !strings.HasSuffix(f.contents, "\n") {
+			_, err = io.WriteString(os.Stdout, "\n")
+		}
+		return err
+	})
+}
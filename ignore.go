@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileName is the name of the files listing paths that -r does not render.
+const ignoreFileName = ".tmplignore"
+
+// ignoreRule is one line of a .tmplignore file, or an -include or -exclude glob.
+type ignoreRule struct {
+	re      *regexp.Regexp // matches the slash-separated path relative to base
+	base    string         // directory the pattern is relative to
+	negate  bool
+	dirOnly bool
+}
+
+// match reports whether the rule matches path, which is under r.base.
+func (r ignoreRule) match(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// parseIgnorePattern compiles a pattern with gitignore syntax, or reports false
+// for blank lines and comments.
+func parseIgnorePattern(line, base string) (ignoreRule, bool) {
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	r := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate, line = true, line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+	// A pattern with a slash other than at the end is relative to base;
+	// otherwise it matches a name at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := globRegexp(line)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp converts a glob with *, ?, [...] and ** to a regular expression.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// pathFilter decides which paths under a -r directory are rendered, from the
+// .tmplignore files in the tree and the -include and -exclude globs.
+type pathFilter struct {
+	tree     sourceTree
+	root     string
+	dirs     map[string][]ignoreRule // rules of the .tmplignore in each directory
+	includes []ignoreRule
+	excludes []ignoreRule
+}
+
+func newPathFilter(tree sourceTree, root string, includes, excludes []string) *pathFilter {
+	return &pathFilter{
+		tree:     tree,
+		root:     root,
+		dirs:     map[string][]ignoreRule{},
+		includes: parseGlobs(includes, root),
+		excludes: parseGlobs(excludes, root),
+	}
+}
+
+// parseGlobs compiles command line globs, which are relative to root.
+func parseGlobs(globs []string, root string) []ignoreRule {
+	var rules []ignoreRule
+	for _, g := range globs {
+		if r, ok := parseIgnorePattern(g, root); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// matchGlobs reports whether the last of rules matching the file at path is not negated.
+func matchGlobs(rules []ignoreRule, path string) bool {
+	matched := false
+	for _, r := range rules {
+		if r.match(path, false) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// skip reports whether path is not rendered. .git directories and .tmplignore files are always skipped.
+// Like git, a file in a skipped directory cannot be included again.
+func (f *pathFilter) skip(path string, isDir bool) (bool, error) {
+	name := filepath.Base(path)
+	if isDir && name == ".git" || !isDir && name == ignoreFileName {
+		return true, nil
+	}
+	// Rules in deeper .tmplignore files come later and so take precedence.
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == f.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules, err := f.rules(dirs[i])
+		if err != nil {
+			return false, err
+		}
+		for _, r := range rules {
+			if r.match(path, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	for _, r := range f.excludes {
+		if r.match(path, isDir) {
+			ignored = !r.negate
+		}
+	}
+	if ignored || isDir || len(f.includes) == 0 {
+		return ignored, nil
+	}
+	return !matchGlobs(f.includes, path), nil
+}
+
+// rules returns the rules of the .tmplignore file in dir, reading it on first use.
+func (f *pathFilter) rules(dir string) ([]ignoreRule, error) {
+	if rules, ok := f.dirs[dir]; ok {
+		return rules, nil
+	}
+	var rules []ignoreRule
+	file, _, err := f.tree.open(filepath.Join(dir, ignoreFileName))
+	if err == nil {
+		s := bufio.NewScanner(file)
+		for s.Scan() {
+			if r, ok := parseIgnorePattern(s.Text(), dir); ok {
+				rules = append(rules, r)
+			}
+		}
+		err = s.Err()
+		file.Close()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.dirs[dir] = rules
+	return rules, nil
+}
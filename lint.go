@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"github.com/tmc/tmpl/sprig"
+	"gopkg.in/yaml.v3"
+)
+
+// lintRule describes a check performed by tmpl lint.
+type lintRule struct {
+	id       string
+	severity string // "error" or "warning"
+	desc     string
+}
+
+var lintRules = []lintRule{
+	{"parse", "error", "Template does not parse"},
+	{"unknown-func", "error", "Call to a function that is not defined"},
+	{"non-hermetic", "warning", "Call to a function whose result depends on time, randomness or the environment"},
+	{"env-call", "warning", "Call to env or expandenv, which reads the process environment instead of the context"},
+	{"unused-define", "warning", "Template defined but never used by template, block, include or component"},
+	{"deprecated-alias", "warning", "Call to a deprecated snake_case alias"},
+	{"whitespace", "warning", "Block action alone on a line without trim markers leaves a blank line in the output"},
+	{"schema-field", "error", "Field that is not present in the schema"},
+}
+
+// deprecatedAliases maps deprecated snake_case function names to their replacements.
+var deprecatedAliases = map[string]string{
+	"date_in_zone":     "dateInZone",
+	"date_modify":      "dateModify",
+	"must_date_modify": "mustDateModify",
+}
+
+// lintDiagnostic is a single finding.
+type lintDiagnostic struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+// linter collects diagnostics across the files of one tmpl lint run.
+type linter struct {
+	known    map[string]bool
+	hermetic map[string]bool
+	disabled map[string]bool
+	schema   any // nil when no schema was given
+
+	diags   []lintDiagnostic
+	defines map[string]lintDiagnostic // define name -> location
+	used    map[string]bool
+}
+
+// runLint implements the lint subcommand and returns the exit code.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpl lint [flags] path...\n\nLints templates and directories of templates. Rules:\n\n")
+		for _, r := range lintRules {
+			fmt.Fprintf(fs.Output(), "  %-17s %s\n", r.id, r.desc)
+		}
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "Output format. Valid values are: text, json, sarif")
+	schemaPath := fs.String("schema", "", "A JSON Schema, or sample data in YAML or JSON, describing the fields available in the context")
+	disable := fs.String("disable", "", "Comma-separated rules to disable")
+	helm := fs.Bool("helm", false, "If true, allow the functions added by -helm")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fmt.Fprintf(os.Stderr, "tmpl lint: invalid -format %q\n", *format)
+		return 2
+	}
+
+	l := newLinter()
+	for _, r := range strings.Split(*disable, ",") {
+		if r != "" {
+			l.disabled[r] = true
+		}
+	}
+	if *helm {
+		l.allowHelm()
+	}
+	if *schemaPath != "" {
+		schema, err := loadLintSchema(*schemaPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tmpl lint:", err)
+			return 2
+		}
+		l.schema = schema
+	}
+	for _, path := range fs.Args() {
+		if err := l.lintPath(path); err != nil {
+			fmt.Fprintln(os.Stderr, "tmpl lint:", err)
+			return 2
+		}
+	}
+	diags := l.finish()
+
+	var err error
+	switch *format {
+	case "json":
+		err = writeLintJSON(os.Stdout, diags)
+	case "sarif":
+		err = writeLintSARIF(os.Stdout, diags)
+	default:
+		for _, d := range diags {
+			fmt.Printf("%s:%d:%d: %s [%s]\n", d.File, d.Line, d.Column, d.Message, d.Rule)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl lint:", err)
+		return 2
+	}
+	if len(diags) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func newLinter() *linter {
+	l := &linter{
+		known:    map[string]bool{},
+		hermetic: map[string]bool{},
+		disabled: map[string]bool{},
+		defines:  map[string]lintDiagnostic{},
+		used:     map[string]bool{},
+	}
+	for _, name := range knownFuncs() {
+		l.known[name] = true
+	}
+	for name := range sprig.HermeticTxtFuncMap() {
+		l.hermetic[name] = true
+	}
+	for _, name := range append(builtinFuncs, knownFuncs()...) {
+		if _, ok := sprig.GenericFuncMap()[name]; !ok {
+			l.hermetic[name] = true
+		}
+	}
+	return l
+}
+
+// allowHelm allows the functions added by -helm. All are hermetic except lookup,
+// which queries a cluster under helm.
+func (l *linter) allowHelm() {
+	for name := range helmFuncMap(nil) {
+		l.known[name] = true
+		l.hermetic[name] = name != "lookup"
+	}
+}
+
+// lintPath lints a template file, or every template under a directory.
+// Hidden directories and data files are skipped.
+func (l *linter) lintPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return l.lintFile(path)
+	}
+	data := newDataFiles(path)
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != path && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || data.isDataFile(p) {
+			return nil
+		}
+		return l.lintFile(p)
+	})
+}
+
+func (l *linter) lintFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p, err := parsePage(string(b))
+	if err != nil {
+		l.report("parse", path, 1, 1, err.Error())
+		return nil
+	}
+	p.name = path
+	l.lintPage(p)
+	return nil
+}
+
+// lintPage lints a single parsed page.
+func (l *linter) lintPage(p *page) {
+	left, right := p.delims()
+	pos := func(n parse.Pos) (int, int) {
+		before := p.body[:min(int(n), len(p.body))]
+		line := strings.Count(before, "\n") + 1
+		col := len(before) - strings.LastIndexByte(before, '\n')
+		return line + p.offset, col
+	}
+
+	t := parse.New(p.name)
+	t.Mode = parse.ParseComments | parse.SkipFuncCheck
+	trees := map[string]*parse.Tree{}
+	if _, err := t.Parse(p.body, left, right, trees); err != nil {
+		line, col := 1, 1
+		if m := templateErrorRE.FindStringSubmatch(err.Error()); m != nil {
+			fmt.Sscan(m[2], &line)
+			line += p.offset
+			err = fmt.Errorf("%s", m[4])
+		}
+		l.report("parse", p.name, line, col, err.Error())
+		return
+	}
+
+	l.lintWhitespace(p, left, right)
+	for name, tree := range trees {
+		if name != p.name {
+			line, col := pos(tree.Root.Pos)
+			l.defines[name] = lintDiagnostic{File: p.name, Line: line, Column: col}
+		}
+		l.walk(tree.Root, name == p.name, name == p.name, pos, p.name)
+	}
+}
+
+// walk checks the nodes under n. rootDot reports whether . is the top-level context,
+// and topLevel whether n is in the file's main template, where $ is.
+func (l *linter) walk(n parse.Node, rootDot, topLevel bool, pos func(parse.Pos) (int, int), file string) {
+	if n == nil {
+		return
+	}
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			l.walk(c, rootDot, topLevel, pos, file)
+		}
+	case *parse.ActionNode:
+		l.walk(n.Pipe, rootDot, topLevel, pos, file)
+	case *parse.IfNode:
+		l.walk(n.Pipe, rootDot, topLevel, pos, file)
+		l.walk(n.List, rootDot, topLevel, pos, file)
+		l.walk(n.ElseList, rootDot, topLevel, pos, file)
+	case *parse.RangeNode:
+		l.walk(n.Pipe, rootDot, topLevel, pos, file)
+		l.walk(n.List, false, topLevel, pos, file)
+		l.walk(n.ElseList, rootDot, topLevel, pos, file)
+	case *parse.WithNode:
+		l.walk(n.Pipe, rootDot, topLevel, pos, file)
+		l.walk(n.List, false, topLevel, pos, file)
+		l.walk(n.ElseList, rootDot, topLevel, pos, file)
+	case *parse.TemplateNode:
+		l.used[n.Name] = true
+		l.walk(n.Pipe, rootDot, topLevel, pos, file)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			l.walk(c, rootDot, topLevel, pos, file)
+		}
+	case *parse.CommandNode:
+		if id, ok := n.Args[0].(*parse.IdentifierNode); ok && len(n.Args) > 1 {
+			if s, ok := n.Args[1].(*parse.StringNode); ok && (id.Ident == "include" || id.Ident == "component") {
+				l.used[s.Text] = true
+			}
+		}
+		for _, c := range n.Args {
+			l.walk(c, rootDot, topLevel, pos, file)
+		}
+	case *parse.ChainNode:
+		l.walk(n.Node, rootDot, topLevel, pos, file)
+	case *parse.IdentifierNode:
+		l.checkFunc(n, pos, file)
+	case *parse.FieldNode:
+		if rootDot {
+			// For a chain such as .A.B.C, the parser records the position of the second field.
+			start := n.Pos
+			if len(n.Ident) > 1 {
+				start -= parse.Pos(len(n.Ident[0]) + 1)
+			}
+			l.checkField(n.Ident, start, pos, file)
+		}
+	case *parse.VariableNode:
+		if topLevel && n.Ident[0] == "$" && len(n.Ident) > 1 {
+			l.checkField(n.Ident[1:], n.Pos, pos, file)
+		}
+	}
+}
+
+func (l *linter) checkFunc(n *parse.IdentifierNode, pos func(parse.Pos) (int, int), file string) {
+	line, col := pos(n.Pos)
+	name := n.Ident
+	switch {
+	case !l.known[name]:
+		msg := fmt.Sprintf("function %q not defined", name)
+		if s := suggestFuncs(name); len(s) > 0 {
+			msg += fmt.Sprintf("; did you mean %s?", strings.Join(s, " or "))
+		}
+		l.report("unknown-func", file, line, col, msg)
+	case name == "env" || name == "expandenv":
+		l.report("env-call", file, line, col, fmt.Sprintf("%s reads the process environment; use the context (e.g. .HOME) instead", name))
+	case !l.hermetic[name]:
+		l.report("non-hermetic", file, line, col, fmt.Sprintf("%s is not hermetic; output will differ between renders", name))
+	}
+	if alt, ok := deprecatedAliases[name]; ok {
+		l.report("deprecated-alias", file, line, col, fmt.Sprintf("%s is deprecated; use %s", name, alt))
+	}
+}
+
+func (l *linter) checkField(fields []string, at parse.Pos, pos func(parse.Pos) (int, int), file string) {
+	if l.schema == nil {
+		return
+	}
+	s := l.schema
+	for i, f := range fields {
+		m, ok := s.(map[string]any)
+		if !ok {
+			return // a leaf or untyped value; anything goes below it
+		}
+		next, ok := m[f]
+		if !ok {
+			line, col := pos(at)
+			l.report("schema-field", file, line, col, fmt.Sprintf("field .%s is not in the schema", strings.Join(fields[:i+1], ".")))
+			return
+		}
+		s = next
+	}
+}
+
+// blockLineRE matches a line holding only a single action.
+var blockLineRE = regexp.MustCompile(`^[ \t]*(.*?)[ \t]*$`)
+
+func (l *linter) lintWhitespace(p *page, left, right string) {
+	for i, line := range strings.Split(p.body, "\n") {
+		s := strings.TrimSpace(blockLineRE.FindStringSubmatch(line)[1])
+		if !strings.HasPrefix(s, left) || actionEnd(s, left, right) != len(s) {
+			continue
+		}
+		if !isBlockAction(s, left, right) || strings.HasPrefix(s, left+"-") || strings.HasSuffix(s, "-"+right) {
+			continue
+		}
+		col := strings.Index(line, left) + 1
+		l.report("whitespace", p.name, i+1+p.offset, col, "block action alone on a line leaves a blank line; use "+left+"- / -"+right+" or -trimblocks")
+	}
+}
+
+func (l *linter) report(rule, file string, line, col int, msg string) {
+	if l.disabled[rule] {
+		return
+	}
+	severity := "warning"
+	for _, r := range lintRules {
+		if r.id == rule {
+			severity = r.severity
+		}
+	}
+	l.diags = append(l.diags, lintDiagnostic{Rule: rule, Severity: severity, File: file, Line: line, Column: col, Message: msg})
+}
+
+// finish reports unused defines and returns all diagnostics sorted by location.
+func (l *linter) finish() []lintDiagnostic {
+	for name, d := range l.defines {
+		if !l.used[name] {
+			l.report("unused-define", d.File, d.Line, d.Column, fmt.Sprintf("template %q is defined but never used", name))
+		}
+	}
+	sort.Slice(l.diags, func(i, j int) bool {
+		a, b := l.diags[i], l.diags[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Rule < b.Rule
+	})
+	return l.diags
+}
+
+// loadLintSchema reads a JSON Schema, or sample data, into a tree of known fields:
+// maps hold the fields of an object and any other value accepts everything below it.
+func loadLintSchema(path string) (any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if m, ok := doc.(map[string]any); ok {
+		if _, ok := m["properties"]; ok {
+			return schemaFields(m), nil
+		}
+	}
+	return doc, nil
+}
+
+// schemaFields converts a JSON Schema object into a tree of known fields.
+func schemaFields(schema map[string]any) any {
+	props, ok := schema["properties"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	if ap, ok := schema["additionalProperties"]; ok && ap != false {
+		return nil
+	}
+	fields := map[string]any{}
+	for name, p := range props {
+		if ps, ok := p.(map[string]any); ok {
+			fields[name] = schemaFields(ps)
+		} else {
+			fields[name] = nil
+		}
+	}
+	return fields
+}
+
+func writeLintJSON(w io.Writer, diags []lintDiagnostic) error {
+	if diags == nil {
+		diags = []lintDiagnostic{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(diags)
+}
+
+// writeLintSARIF writes diags as a SARIF 2.1.0 log, as consumed by code scanning tools.
+func writeLintSARIF(w io.Writer, diags []lintDiagnostic) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+	type rule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+	type region struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn"`
+	}
+	type artifactLocation struct {
+		URI string `json:"uri"`
+	}
+	type physicalLocation struct {
+		ArtifactLocation artifactLocation `json:"artifactLocation"`
+		Region           region           `json:"region"`
+	}
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	rules := make([]rule, len(lintRules))
+	for i, r := range lintRules {
+		rules[i] = rule{ID: r.id, ShortDescription: message{r.desc}}
+	}
+	results := make([]result, len(diags))
+	for i, d := range diags {
+		results[i] = result{
+			RuleID:  d.Rule,
+			Level:   d.Severity,
+			Message: message{d.Message},
+			Locations: []location{{physicalLocation{
+				ArtifactLocation: artifactLocation{filepath.ToSlash(d.File)},
+				Region:           region{d.Line, d.Column},
+			}}},
+		}
+	}
+	log := map[string]any{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []any{map[string]any{
+			"tool":    map[string]any{"driver": map[string]any{"name": "tmpl", "informationUri": "https://github.com/tmc/tmpl", "rules": rules}},
+			"results": results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
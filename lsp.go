@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// builtinDocs documents the functions predefined by text/template.
+// sprig replaces slice, len and the comparison functions, so those describe its versions.
+var builtinDocs = map[string][2]string{
+	"and":      {"and(arg ...any) any", "Returns the first empty argument or the last argument."},
+	"call":     {"call(fn any, arg ...any) any", "Calls fn, which must be a function value, with the remaining arguments."},
+	"html":     {"html(arg ...any) string", "Returns the escaped HTML equivalent of the textual representation of its arguments."},
+	"index":    {"index(item any, indexes ...any) any", "Returns the result of indexing item by the following arguments: index x 1 2 3 is x[1][2][3]."},
+	"slice":    {"slice(list any, indices ...any) any", "Returns the part of a list between a start and an optional end index, negative indices counting from the end: slice .List 1 3."},
+	"js":       {"js(arg ...any) string", "Returns the escaped JavaScript equivalent of the textual representation of its arguments."},
+	"len":      {"len(v any) int", "Returns the length of a list, map, string or channel, or 0 for any other value."},
+	"not":      {"not(arg any) bool", "Returns the boolean negation of its single argument."},
+	"or":       {"or(arg ...any) any", "Returns the first non-empty argument or the last argument."},
+	"print":    {"print(arg ...any) string", "An alias for fmt.Sprint."},
+	"printf":   {"printf(format string, arg ...any) string", "An alias for fmt.Sprintf."},
+	"println":  {"println(arg ...any) string", "An alias for fmt.Sprintln."},
+	"urlquery": {"urlquery(arg ...any) string", "Returns the escaped value of the textual representation of its arguments in a form suitable for embedding in a URL query."},
+	"eq":       {"eq(a, b any) bool", "Reports whether two values are deeply equal."},
+	"ne":       {"ne(a, b any) bool", "Reports whether two values are not deeply equal."},
+	"lt":       {"lt(a, b any) bool", "Reports whether a < b, comparing both as float64."},
+	"le":       {"le(a, b any) bool", "Reports whether a <= b, comparing both as float64."},
+	"gt":       {"gt(a, b any) bool", "Reports whether a > b, comparing both as float64."},
+	"ge":       {"ge(a, b any) bool", "Reports whether a >= b, comparing both as float64."},
+}
+
+// templateKeywords are offered as completions at the start of an action.
+var templateKeywords = []string{"if", "else", "end", "range", "with", "define", "template", "block", "break", "continue"}
+
+// lspServer implements the Language Server Protocol over a stream.
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]string // open documents by URI
+	schema   any               // known context fields; nil if unknown
+	roots    []string          // directories searched for define
+	shutdown bool
+}
+
+// runLSP implements the lsp subcommand and returns the exit code.
+func runLSP(args []string) int {
+	fs := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpl lsp [flags]\n\nRuns a language server for templates over stdin and stdout.\n\n")
+		fs.PrintDefaults()
+	}
+	schemaPath := fs.String("schema", "", "A JSON Schema, or sample data in YAML or JSON, used to complete and check context fields")
+	var partials stringsFlag
+	fs.Var(&partials, "partials", "A directory searched for define, in addition to the workspace (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	s := &lspServer{in: bufio.NewReader(os.Stdin), out: os.Stdout, docs: map[string]string{}, roots: partials}
+	if *schemaPath != "" {
+		schema, err := loadLintSchema(*schemaPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tmpl lsp:", err)
+			return 2
+		}
+		s.schema = schema
+	}
+	if err := s.serve(); err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl lsp:", err)
+		return 1
+	}
+	return 0
+}
+
+// lspMessage is a JSON-RPC 2.0 request, response or notification.
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// serve handles messages until exit or the end of input.
+func (s *lspServer) serve() error {
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, rerr := s.handle(msg)
+		if msg.ID == nil {
+			continue // a notification
+		}
+		resp := &lspMessage{JSONRPC: "2.0", ID: msg.ID, Error: rerr}
+		if rerr == nil {
+			resp.Result = result
+			if result == nil {
+				resp.Result = json.RawMessage("null")
+			}
+		}
+		if err := s.write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads one message framed with a Content-Length header.
+func (s *lspServer) read() (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("bad Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	msg := new(lspMessage)
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *lspServer) write(msg *lspMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *lspServer) notify(method string, params any) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.write(&lspMessage{Method: method, Params: b})
+}
+
+func (s *lspServer) handle(msg *lspMessage) (any, *lspError) {
+	if s.shutdown && msg.Method != "exit" {
+		return nil, &lspError{-32600, "server is shut down"}
+	}
+	switch msg.Method {
+	case "initialize":
+		var params struct {
+			RootURI          string `json:"rootUri"`
+			WorkspaceFolders []struct {
+				URI string `json:"uri"`
+			} `json:"workspaceFolders"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if params.RootURI != "" {
+			s.roots = append(s.roots, uriPath(params.RootURI))
+		}
+		for _, f := range params.WorkspaceFolders {
+			if f.URI != params.RootURI {
+				s.roots = append(s.roots, uriPath(f.URI))
+			}
+		}
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":      1, // full
+				"completionProvider":    map[string]any{"triggerCharacters": []string{".", "|", "(", " "}},
+				"signatureHelpProvider": map[string]any{"triggerCharacters": []string{" ", "("}},
+				"hoverProvider":         true,
+				"definitionProvider":    true,
+			},
+			"serverInfo": map[string]any{"name": "tmpl"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		s.docs[params.TextDocument.URI] = params.TextDocument.Text
+		s.publishDiagnostics(params.TextDocument.URI)
+		return nil, nil
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.docs[params.TextDocument.URI] = params.ContentChanges[n-1].Text
+			s.publishDiagnostics(params.TextDocument.URI)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		json.Unmarshal(msg.Params, &params)
+		delete(s.docs, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": params.TextDocument.URI, "diagnostics": []any{}})
+		return nil, nil
+	case "textDocument/completion", "textDocument/hover", "textDocument/signatureHelp", "textDocument/definition":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		text, ok := s.docs[params.TextDocument.URI]
+		if !ok {
+			return nil, nil
+		}
+		offset := lspOffset(text, params.Position)
+		switch msg.Method {
+		case "textDocument/completion":
+			return s.completion(text, offset), nil
+		case "textDocument/hover":
+			return s.hover(text, offset), nil
+		case "textDocument/signatureHelp":
+			return s.signatureHelp(text, offset), nil
+		default:
+			return s.definition(params.TextDocument.URI, text, offset), nil
+		}
+	}
+	if strings.HasPrefix(msg.Method, "$/") {
+		return nil, nil
+	}
+	return nil, &lspError{-32601, fmt.Sprintf("method %q not supported", msg.Method)}
+}
+
+// publishDiagnostics sends the lint findings for the document at uri.
+func (s *lspServer) publishDiagnostics(uri string) {
+	text := s.docs[uri]
+	l := newLinter()
+	l.schema = s.schema
+	l.disabled["unused-define"] = true // defines are often used from other files
+	diags := []any{}
+	p, err := parsePage(text)
+	if err != nil {
+		l.report("parse", uri, 1, 1, err.Error())
+	} else {
+		p.name = uri
+		l.lintPage(p)
+	}
+	for _, d := range l.finish() {
+		severity := 2
+		if d.Severity == "error" {
+			severity = 1
+		}
+		// Diagnostics cover the rest of the line.
+		line := lineOffset(text, d.Line)
+		start := lspPositionAt(text, line+d.Column-1)
+		end := lspPositionAt(text, line+len(nthLine(text, d.Line)))
+		diags = append(diags, map[string]any{
+			"range":    lspRange{start, end},
+			"severity": severity,
+			"code":     d.Rule,
+			"source":   "tmpl",
+			"message":  d.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": diags})
+}
+
+// actionAt returns the text of the action containing offset, from after its
+// left delimiter up to offset, and whether offset is inside an action.
+func actionAt(text string, offset int) (string, bool) {
+	p, err := parsePage(text)
+	left, right := "{{", "}}"
+	if err == nil {
+		left, right = p.delims()
+	}
+	before := text[:offset]
+	i := strings.LastIndex(before, left)
+	if i < 0 || strings.Contains(before[i:], right) {
+		return "", false
+	}
+	return strings.TrimPrefix(before[i+len(left):], "-"), true
+}
+
+// wordAt returns the identifier, field or variable chain around offset.
+func wordAt(text string, offset int) (string, int) {
+	isWord := func(c byte) bool {
+		return c == '.' || c == '$' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	start, end := offset, offset
+	for start > 0 && isWord(text[start-1]) {
+		start--
+	}
+	for end < len(text) && isWord(text[end]) {
+		end++
+	}
+	return text[start:end], start
+}
+
+func (s *lspServer) completion(text string, offset int) any {
+	action, ok := actionAt(text, offset)
+	if !ok {
+		return []any{}
+	}
+	_, start := wordAt(text, offset)
+	word := text[start:offset]
+	items := []any{}
+	if strings.HasPrefix(word, ".") || strings.HasPrefix(word, "$.") {
+		i := strings.LastIndexByte(word, '.')
+		v, ok := lookupPath(s.schema, splitPath(strings.TrimPrefix(word[:i], "$")))
+		if !ok {
+			return items
+		}
+		for _, k := range mapKeys(v) {
+			if !strings.HasPrefix(k, word[i+1:]) {
+				continue
+			}
+			item := map[string]any{"label": k, "kind": 5}
+			if val, _ := lookupPath(v, []string{k}); val != nil {
+				item["detail"] = summarize(val)
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	if strings.TrimSpace(strings.TrimSuffix(action, word)) == "" {
+		for _, k := range templateKeywords {
+			items = append(items, map[string]any{"label": k, "kind": 14})
+		}
+	}
+	for _, name := range knownFuncs() {
+		if !strings.HasPrefix(name, word) {
+			continue
+		}
+		sig, doc := funcDoc(name)
+		items = append(items, map[string]any{"label": name, "kind": 3, "detail": sig, "documentation": doc})
+	}
+	return items
+}
+
+func (s *lspServer) hover(text string, offset int) any {
+	if _, ok := actionAt(text, offset); !ok {
+		return nil
+	}
+	word, _ := wordAt(text, offset)
+	var md string
+	switch {
+	case word == "":
+		return nil
+	case strings.HasPrefix(word, ".") || strings.HasPrefix(word, "$."):
+		v, ok := lookupPath(s.schema, splitPath(strings.TrimPrefix(word, "$")))
+		if !ok || s.schema == nil {
+			return nil
+		}
+		md = fmt.Sprintf("`%s`: %s", word, summarize(v))
+	default:
+		sig, doc := funcDoc(word)
+		if sig == "" {
+			return nil
+		}
+		md = fmt.Sprintf("```go\n%s\n```\n%s", sig, doc)
+	}
+	return map[string]any{"contents": map[string]any{"kind": "markdown", "value": md}}
+}
+
+func (s *lspServer) signatureHelp(text string, offset int) any {
+	action, ok := actionAt(text, offset)
+	if !ok {
+		return nil
+	}
+	// The current command starts after the last | or unclosed (.
+	cmd := action
+	depth := 0
+	for i := len(action) - 1; i >= 0; i-- {
+		switch action[i] {
+		case ')':
+			depth++
+		case '(':
+			if depth == 0 {
+				cmd = action[i+1:]
+				i = -1
+				continue
+			}
+			depth--
+		case '|':
+			if depth == 0 {
+				cmd = action[i+1:]
+				i = -1
+				continue
+			}
+		}
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return nil
+	}
+	name := fields[0]
+	sig, doc := funcDoc(name)
+	if sig == "" {
+		return nil
+	}
+	params := funcParams(sig)
+	active := len(fields) - 1
+	if !strings.HasSuffix(cmd, " ") {
+		active--
+	}
+	active = max(0, min(active, len(params)-1))
+	var paramInfo []any
+	for _, p := range params {
+		paramInfo = append(paramInfo, map[string]any{"label": p})
+	}
+	return map[string]any{
+		"signatures":      []any{map[string]any{"label": sig, "documentation": doc, "parameters": paramInfo}},
+		"activeSignature": 0,
+		"activeParameter": active,
+	}
+}
+
+// definitionNameRE matches the template name argument of template, block, include and component.
+var definitionNameRE = regexp.MustCompile(`\b(?:template|block|define|include|component)\s+"([^"]*)"`)
+
+func (s *lspServer) definition(uri, text string, offset int) any {
+	action, ok := actionAt(text, offset)
+	if !ok {
+		return nil
+	}
+	// Include the rest of the name after the cursor.
+	rest := text[offset:]
+	if i := strings.IndexByte(rest, '"'); i >= 0 {
+		action += rest[:i+1]
+	}
+	m := definitionNameRE.FindAllStringSubmatch(action, -1)
+	if m == nil {
+		return nil
+	}
+	name := m[len(m)-1][1]
+	var locs []lspLocation
+	seen := map[string]bool{}
+	for _, u := range sortedDocURIs(s.docs) {
+		seen[uriPath(u)] = true
+		locs = append(locs, findDefines(u, s.docs[u], name)...)
+	}
+	for _, root := range s.roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() || info.Size() > 1<<20 || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			b, err := os.ReadFile(path)
+			if err != nil || !utf8.Valid(b) {
+				return nil
+			}
+			locs = append(locs, findDefines(pathURI(path), string(b), name)...)
+			return nil
+		})
+	}
+	if locs == nil {
+		return []lspLocation{}
+	}
+	return locs
+}
+
+func sortedDocURIs(docs map[string]string) []string {
+	uris := make([]string, 0, len(docs))
+	for u := range docs {
+		uris = append(uris, u)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// findDefines returns the locations of {{define "name"}} and {{block "name"}} in text.
+func findDefines(uri, text, name string) []lspLocation {
+	p, err := parsePage(text)
+	left := "{{"
+	if err == nil {
+		left, _ = p.delims()
+	}
+	re := regexp.MustCompile(regexp.QuoteMeta(left) + `-?\s*(?:define|block)\s+("` + regexp.QuoteMeta(name) + `")`)
+	var locs []lspLocation
+	for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+		locs = append(locs, lspLocation{uri, lspRange{lspPositionAt(text, m[2]), lspPositionAt(text, m[3])}})
+	}
+	return locs
+}
+
+// funcDoc returns the signature and documentation of the named function, or "" if it is unknown or undocumented.
+func funcDoc(name string) (string, string) {
+	if d, ok := builtinDocs[name]; ok {
+		return d[0], d[1]
+	}
+	doc, ok := funcDocs[name]
+	if !ok {
+		return "", ""
+	}
+	for _, m := range []map[string]any{txtFuncMap(), fileFuncs(false), new(components).funcs(false)} {
+		if fn, ok := m[name]; ok {
+			return funcSignature(name, fn), doc
+		}
+	}
+	return "", ""
+}
+
+// funcSignature formats the signature of fn, such as "trimSuffix(string, string) string".
+func funcSignature(name string, fn any) string {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return name
+	}
+	var in []string
+	for i := 0; i < t.NumIn(); i++ {
+		s := t.In(i).String()
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			s = "..." + t.In(i).Elem().String()
+		}
+		in = append(in, strings.ReplaceAll(s, "interface {}", "any"))
+	}
+	var out []string
+	for i := 0; i < t.NumOut(); i++ {
+		out = append(out, strings.ReplaceAll(t.Out(i).String(), "interface {}", "any"))
+	}
+	sig := name + "(" + strings.Join(in, ", ") + ")"
+	switch len(out) {
+	case 0:
+	case 1:
+		sig += " " + out[0]
+	default:
+		sig += " (" + strings.Join(out, ", ") + ")"
+	}
+	return sig
+}
+
+// funcParams returns the parameters of a signature formatted by funcSignature or builtinDocs.
+func funcParams(sig string) []string {
+	i, j := strings.IndexByte(sig, '('), strings.IndexByte(sig, ')')
+	if i < 0 || j < i || j == i+1 {
+		return nil
+	}
+	return strings.Split(sig[i+1:j], ", ")
+}
+
+// lineOffset returns the byte offset of the start of the 1-based line n in text.
+func lineOffset(text string, n int) int {
+	offset := 0
+	for i := 1; i < n; i++ {
+		j := strings.IndexByte(text[offset:], '\n')
+		if j < 0 {
+			return len(text)
+		}
+		offset += j + 1
+	}
+	return offset
+}
+
+// lspOffset converts an LSP position, whose character is in UTF-16 code units, to a byte offset in text.
+func lspOffset(text string, pos lspPosition) int {
+	offset := lineOffset(text, pos.Line+1)
+	for units := 0; units < pos.Character && offset < len(text) && text[offset] != '\n'; {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		units += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+// lspPositionAt converts a byte offset in text to an LSP position.
+func lspPositionAt(text string, offset int) lspPosition {
+	offset = min(offset, len(text))
+	before := text[:offset]
+	line := strings.Count(before, "\n")
+	return lspPosition{line, utf16Len(before[strings.LastIndexByte(before, '\n')+1:])}
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// uriPath returns the file path of a file:// URI.
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	htmltemplate "html/template"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/tmc/tmpl/sprig"
 )
@@ -20,34 +26,159 @@ var (
 	flagInput     = flag.String("f", "-", "Input source")
 	flagOutput    = flag.String("w", "-", "Output destination")
 	flagHTML      = flag.Bool("html", false, "If true, use html/template instead of text/template")
-	flagRecursive = flag.String("r", "", "If provided, traverse the argument as a directory")
+	flagRecursive = flag.String("r", "", "If provided, traverse the argument as a directory, or read it as an archive if it ends in .txtar, .tar, .tar.gz, .tgz or .zip, or is - (stdin)")
 	flagStripN    = flag.Int("stripn", 0, "If provided, strips this many directories from the output (only valid if -r and -w are provided)")
 	flagTxtar     = flag.Bool("txtar", false, "If true, output in txtar format instead of tar (only valid with -r)")
+	flagInclude   = stringsVar("include", "With -r, only render files matching this glob (may be repeated); globs use .tmplignore syntax")
+	flagSuffix    = flag.String("suffix", "", "With -r, only render files with this suffix (e.g. .tmpl) and strip it from the output name; other files are copied verbatim")
+	flagJobs      = flag.Int("j", runtime.NumCPU(), "With -r, the number of files to render in parallel; output order does not depend on it")
+	flagMtime     = flag.Bool("mtime", false, "With -r, keep the modification times of source files and directories in the output")
+	flagOwner     = flag.Bool("owner", false, "With -r, keep the owner and group of source files in the output; extracting with -w usually requires root")
+	flagBinary    = stringsVar("binary", "With -r, copy files matching this glob verbatim as binary files (may be repeated)")
+	flagText      = stringsVar("text", "With -r, render files matching this glob even if they look binary (may be repeated); -text '*' disables binary detection")
+	flagExclude   = stringsVar("exclude", "With -r, skip files and directories matching this glob (may be repeated); globs use .tmplignore syntax")
+
+	flagTrimBlocks   = flag.Bool("trimblocks", false, "If true, remove the first newline after a block action (if, range, with, define, end, ...)")
+	flagLstripBlocks = flag.Bool("lstripblocks", false, "If true, strip spaces and tabs from the start of a line up to a block action")
+
+	flagSyntax      = flag.String("syntax", "go", "Template syntax. Valid values are: go (text/template), envsubst (shell-style $VAR, ${VAR:-default} references)")
+	flagShellFormat = flag.String("shellformat", "", "With -syntax=envsubst, only substitute the variables named in this string (e.g. '$HOME ${USER}'), like envsubst's SHELL-FORMAT argument")
+
+	flagHelm          = flag.Bool("helm", false, "If true, render the chart directory given with -r like helm template, with .Values, .Release, .Chart and .Files")
+	flagHelmValues    = stringsVar("values", "With -helm, a values file merged over the chart's values.yaml (may be repeated)")
+	flagHelmSet       = stringsVar("set", "With -helm, value overrides such as a.b=1,c=x (may be repeated)")
+	flagHelmRelease   = flag.String("release", "release-name", "With -helm, the release name")
+	flagHelmNamespace = flag.String("namespace", "default", "With -helm, the release namespace")
+
+	flagStrict = flag.Bool("strict", false, "If true, functions that silently fall back to a zero value on bad input (atoi, toDate, fromJson, b64dec, div, ...) fail the render instead")
+
+	flagTrace       = flag.Bool("trace", false, "If true, print a trace of each action executed, with argument values and results, to stderr; values of fields named like secrets are redacted")
+	flagTraceFormat = flag.String("traceformat", "tree", "With -trace, the trace format. Valid values are: tree, json")
+	flagCover       = flag.String("cover", "", "If provided, add the number of times each action and branch executed to this coverage profile; see tmpl cover")
 
 	flagMissingKey = flag.String("missingkey", "default", "Controls behavior during execution if a map is indexed with a key that is not present in the map. Valid values are: default, zero, error")
 )
 
+// stringsFlag is a flag that may be repeated, collecting each value.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func stringsVar(name, usage string) *stringsFlag {
+	s := new(stringsFlag)
+	flag.Var(s, name, usage)
+	return s
+}
+
+// subcommands are run by tmpl <name> [flags], returning the exit code.
+var subcommands = map[string]func(args []string) int{
+	"lint":  runLint,
+	"fmt":   runFmt,
+	"repl":  runRepl,
+	"cover": runCover,
+	"lsp":   runLSP,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 	flag.Parse()
-	if err := run(*flagInput, *flagOutput, *flagRecursive, *flagHTML); err != nil {
+	err := run(*flagInput, *flagOutput, *flagRecursive, *flagHTML)
+	if *flagCover != "" {
+		if cerr := writeCoverProfile(*flagCover); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, "tmpl error:", err)
 		os.Exit(1)
 	}
 }
 
 func run(input, output string, recurseDir string, htmlMode bool) error {
+	if *flagSyntax != "go" && *flagSyntax != "envsubst" {
+		return fmt.Errorf("invalid -syntax %q: valid values are: go, envsubst", *flagSyntax)
+	}
+	if *flagTraceFormat != "tree" && *flagTraceFormat != "json" {
+		return fmt.Errorf("invalid -traceformat %q: valid values are: tree, json", *flagTraceFormat)
+	}
 	in, err := getInput(input)
 	if err != nil {
 		return err
 	}
+	if *flagHelm {
+		if recurseDir == "" {
+			return fmt.Errorf("-helm requires -r")
+		}
+		return runHelm(recurseDir, output, *flagStripN, *flagTxtar)
+	}
 	if recurseDir != "" {
 		return runDir(recurseDir, htmlMode, output, *flagStripN, *flagTxtar, envMap())
 	}
-	out, err := getOutput(*flagOutput)
+	p, err := readPage(in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", (&page{name: input}).displayName(), err)
+	}
+	p.name = input
+	ctx, err := p.context(envMap())
+	if err != nil {
+		return err
+	}
+	if skip, err := p.skip(ctx); err != nil || skip {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := p.execute(htmlMode, buf, ctx); err != nil {
+		return err
+	}
+	main, files, err := splitFiles(buf.String())
 	if err != nil {
 		return err
 	}
-	return tmpl(in, *flagHTML, out, envMap())
+	if len(files) > 0 && output == "-" {
+		return fmt.Errorf("%s: file %q needs -w: emitted files are written next to the output file", p.displayName(), files[0].name)
+	}
+	dir := "."
+	if output != "-" {
+		dir = filepath.Dir(output)
+	}
+	name, err := p.outputName(ctx)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		output = filepath.Join(dir, name)
+	}
+	if output != "-" {
+		if err := ensureEnclosingDir(output); err != nil {
+			return fmt.Errorf("issue ensuring directory exists: %w", err)
+		}
+	}
+	out, err := getOutput(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, main); err != nil {
+		return err
+	}
+	mode, err := p.mode()
+	if err != nil {
+		return err
+	}
+	if mode != 0 && output != "-" {
+		if err := os.Chmod(output, mode); err != nil {
+			return err
+		}
+	}
+	return writeFiles(dir, files)
 }
 
 func getInput(path string) (io.Reader, error) {
@@ -74,25 +205,163 @@ func envMap() map[string]string {
 }
 
 func tmpl(in io.Reader, htmlMode bool, out io.Writer, ctx any) error {
-	i, err := io.ReadAll(in)
+	p, err := readPage(in)
 	if err != nil {
 		return err
 	}
+	ctx, err = p.context(ctx)
+	if err != nil {
+		return err
+	}
+	return p.execute(htmlMode, out, ctx)
+}
 
-	if htmlMode {
-		tmpl, err := htmltemplate.New("format string").Funcs(sprig.HtmlFuncMap()).Parse(string(i))
+// execute renders the page body to out, honoring the front matter delims and html options.
+// With -syntax=envsubst the body is expanded with envsubst instead.
+func (p *page) execute(htmlMode bool, out io.Writer, ctx any) error {
+	if *flagSyntax == "envsubst" {
+		allowed, err := parseShellFormat(*flagShellFormat)
 		if err != nil {
 			return err
 		}
+		s, err := envsubst(p.body, ctx, allowed)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.displayName(), err)
+		}
+		_, err = io.WriteString(out, s)
+		return err
+	}
+	left, right := p.delims()
+	src, shifts := stripBlocksShifts(p.body, left, right, *flagTrimBlocks, *flagLstripBlocks)
+
+	c := new(components)
+	tr := newTracer(p, p.isHTML(htmlMode))
+	cv := newPageCover(p, src, shifts)
+	if p.isHTML(htmlMode) {
+		tmpl, err := newHTMLTemplate(p.displayName()).Delims(left, right).Funcs(c.funcs(true)).Parse(src)
+		if err != nil {
+			return p.annotate(err, shifts)
+		}
 		tmpl = tmpl.Option(fmt.Sprintf("missingkey=%s", *flagMissingKey))
-		return tmpl.Execute(out, ctx)
+		var trees []*parse.Tree
+		for _, t := range tmpl.Templates() {
+			if t.Tree != nil {
+				trees = append(trees, t.Tree)
+			}
+		}
+		funcs, err := instrument(trees, cv, tr)
+		if err != nil {
+			return err
+		}
+		return p.annotate(tr.done(c.execute(tmpl.Funcs(funcs), tmpl.Name(), out, ctx)), shifts)
 	}
-	tmpl, err := template.New("format string").Funcs(sprig.TxtFuncMap()).Parse(string(i))
+	tmpl, err := newTxtTemplate(p.displayName()).Delims(left, right).Funcs(c.funcs(false)).Parse(src)
 	if err != nil {
-		return err
+		return p.annotate(err, shifts)
 	}
 	tmpl = tmpl.Option(fmt.Sprintf("missingkey=%s", *flagMissingKey))
-	return tmpl.Execute(out, ctx)
+	var trees []*parse.Tree
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			trees = append(trees, t.Tree)
+		}
+	}
+	funcs, err := instrument(trees, cv, tr)
+	if err != nil {
+		return err
+	}
+	return p.annotate(tr.done(c.execute(tmpl.Funcs(funcs), tmpl.Name(), out, ctx)), shifts)
+}
+
+// instrument rewrites trees for -cover and -trace, either of which may be nil,
+// and returns the functions the rewritten trees call.
+func instrument(trees []*parse.Tree, cv *pageCover, tr *tracer) (template.FuncMap, error) {
+	funcs := template.FuncMap{}
+	if cv != nil {
+		for _, t := range trees {
+			if err := cv.rewrite(t); err != nil {
+				return nil, err
+			}
+		}
+		maps.Copy(funcs, cv.funcs())
+	}
+	if tr != nil {
+		for _, t := range trees {
+			if err := tr.rewrite(t); err != nil {
+				return nil, err
+			}
+		}
+		maps.Copy(funcs, tr.funcs())
+	}
+	return funcs, nil
+}
+
+// The sprig function maps are built once per run and shared; callers must not modify them.
+var (
+	txtFuncs        = sync.OnceValue(sprig.TxtFuncMap)
+	strictTxtFuncs  = sync.OnceValue(sprig.StrictTxtFuncMap)
+	htmlFuncs       = sync.OnceValue(sprig.HtmlFuncMap)
+	strictHTMLFuncs = sync.OnceValue(sprig.StrictHtmlFuncMap)
+)
+
+// txtFuncMap returns the sprig functions for text templates, honoring -strict.
+func txtFuncMap() template.FuncMap {
+	if *flagStrict {
+		return strictTxtFuncs()
+	}
+	return txtFuncs()
+}
+
+// htmlFuncMap returns the sprig functions for html templates, honoring -strict.
+func htmlFuncMap() htmltemplate.FuncMap {
+	if *flagStrict {
+		return strictHTMLFuncs()
+	}
+	return htmlFuncs()
+}
+
+// Base template sets with the sprig, file and component functions already added, built once per run.
+// Each page clones one, which is much cheaper than checking every function again with Funcs.
+var (
+	txtBase        = sync.OnceValue(func() *template.Template { return newTxtBase(txtFuncs()) })
+	strictTxtBase  = sync.OnceValue(func() *template.Template { return newTxtBase(strictTxtFuncs()) })
+	htmlBase       = sync.OnceValue(func() *htmltemplate.Template { return newHTMLBase(htmlFuncs()) })
+	strictHTMLBase = sync.OnceValue(func() *htmltemplate.Template { return newHTMLBase(strictHTMLFuncs()) })
+)
+
+func newTxtBase(funcs template.FuncMap) *template.Template {
+	return template.New("").Funcs(funcs).Funcs(fileFuncs(false)).Funcs(new(components).funcs(false))
+}
+
+func newHTMLBase(funcs htmltemplate.FuncMap) *htmltemplate.Template {
+	return htmltemplate.New("").Funcs(funcs).Funcs(fileFuncs(true)).Funcs(new(components).funcs(true))
+}
+
+// newTxtTemplate returns an empty text template named name, with the functions of the base set.
+func newTxtTemplate(name string) *template.Template {
+	base := txtBase
+	if *flagStrict {
+		base = strictTxtBase
+	}
+	t, err := base().Clone()
+	if err != nil {
+		// The base set is never executed, so it can always be cloned.
+		panic(err)
+	}
+	return t.New(name)
+}
+
+// newHTMLTemplate returns an empty html template named name, with the functions of the base set.
+func newHTMLTemplate(name string) *htmltemplate.Template {
+	base := htmlBase
+	if *flagStrict {
+		base = strictHTMLBase
+	}
+	t, err := base().Clone()
+	if err != nil {
+		panic(err)
+	}
+	return t.New(name)
 }
 
 func tmplToString(in io.Reader, htmlMode bool, ctx any) (string, error) {
@@ -101,99 +370,461 @@ func tmplToString(in io.Reader, htmlMode bool, ctx any) (string, error) {
 	return o.String(), err
 }
 
-func tmplStr(in string, ctx any) string {
-	o := bytes.NewBuffer([]byte{})
-	err := tmpl(strings.NewReader(in), false, o, ctx)
+// runDir renders the tree named by -r, which is a directory or an archive; see openSourceTree.
+func runDir(dir string, htmlMode bool, outPath string, stripN int, txtarMode bool, ctx any) error {
+	tree, root, err := openSourceTree(dir)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "issue rendering string:", err)
+		return err
 	}
-	return o.String()
+	defer tree.close()
+	walk := func(emit func(renderedFile) error) error {
+		return walkDir(tree, root, htmlMode, ctx, emit)
+	}
+	return writeOutputs(walk, outPath, stripN, txtarMode)
 }
 
-func runDir(dir string, htmlMode bool, outPath string, stripN int, txtarMode bool, ctx any) error {
-	buf := new(bytes.Buffer)
+// walkFunc produces rendered files, calling emit for each in output order.
+type walkFunc func(emit func(renderedFile) error) error
+
+// writeOutputs writes the files produced by walk in the format selected by -txtar and -w.
+func writeOutputs(walk walkFunc, outPath string, stripN int, txtarMode bool) error {
 	if txtarMode {
-		return runDirTxtar(dir, htmlMode, outPath, stripN, ctx)
+		return writeTxtar(walk, outPath, stripN)
 	}
-	tw := tar.NewWriter(buf)
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	return writeTar(walk, outPath, stripN)
+}
+
+// writeTar writes the files produced by walk as a tar archive to stdout, or extracts them under outPath.
+// Entries are written as they are produced, so only one file is held in memory at a time;
+// if walk fails, the output holds the entries written so far.
+func writeTar(walk walkFunc, outPath string, stripN int) error {
+	if outPath != "-" {
+		x := &extractor{outPath: outPath, stripN: stripN}
+		err := walk(func(f renderedFile) error {
+			return writeTarEntry(f, x.extract)
+		})
 		if err != nil {
+			return fmt.Errorf("issue recursing: %w", err)
+		}
+		return x.finish()
+	}
+	w := bufio.NewWriter(os.Stdout)
+	tw := tar.NewWriter(w)
+	err := walk(func(f renderedFile) error {
+		return writeTarEntry(f, func(hdr *tar.Header, r io.Reader) error {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
 			return err
+		})
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return fmt.Errorf("issue recursing: %w", err)
+	}
+	return nil
+}
+
+// writeTarEntry passes the tar header and contents of f to write.
+func writeTarEntry(f renderedFile, write func(*tar.Header, io.Reader) error) error {
+	r, size, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hdr, err := tarHeader(f, size)
+	if err != nil {
+		return err
+	}
+	return write(hdr, io.LimitReader(r, size))
+}
+
+// tarHeader returns the tar header for f, including the source modification time and ownership with -mtime and -owner.
+func tarHeader(f renderedFile, size int64) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(f.name),
+		Mode:     int64(f.mode.Perm()),
+		Size:     size,
+	}
+	switch {
+	case f.mode.IsDir():
+		hdr.Typeflag, hdr.Name, hdr.Size = tar.TypeDir, hdr.Name+"/", 0
+	case f.mode&os.ModeSymlink != 0:
+		hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, f.linkname, 0
+	}
+	for bit, mode := range map[os.FileMode]int64{os.ModeSetuid: 04000, os.ModeSetgid: 02000, os.ModeSticky: 01000} {
+		if f.mode&bit != 0 {
+			hdr.Mode |= mode
 		}
-		if !info.Mode().IsRegular() {
-			return nil
+	}
+	if f.info == nil {
+		return hdr, nil
+	}
+	if *flagMtime {
+		hdr.ModTime = f.info.ModTime()
+	}
+	if *flagOwner {
+		src, err := tar.FileInfoHeader(f.info, f.linkname)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", f.name, err)
 		}
-		f, err := os.Open(path)
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = src.Uid, src.Gid, src.Uname, src.Gname
+	}
+	return hdr, nil
+}
+
+// walkDir renders every template under dir and calls emit for each output, in walk order, which is sorted by path.
+// Templates are rendered on -j workers. Rendering errors do not stop the walk; they are returned together at the end.
+// Data files are merged into the context of the templates they apply to instead of being rendered.
+// Paths skipped by .tmplignore files or the -include and -exclude flags are not rendered.
+// With -suffix, files without the suffix are copied unchanged, as are binary files, which are listed on stderr.
+// Directories and symlinks are emitted too, with their names and link targets rendered.
+func walkDir(tree sourceTree, dir string, htmlMode bool, ctx any, emit func(renderedFile) error) error {
+	data := newTreeDataFiles(tree, dir)
+	root := filepath.Clean(dir)
+	filter := newPathFilter(tree, root, *flagInclude, *flagExclude)
+	binaryGlobs, textGlobs := parseGlobs(*flagBinary, root), parseGlobs(*flagText, root)
+	jobs := *flagJobs
+	if *flagTrace {
+		// Traces are written as each template finishes, so render in order.
+		jobs = 1
+	}
+	pool := newRenderPool(jobs, tree, htmlMode, emit)
+	var binaries []string
+	err := tree.walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		contents, err := tmplToString(f, htmlMode, ctx)
-		if err != nil {
-			return fmt.Errorf("%v: %w", path, err)
+		if pool.stopped() {
+			return errStopped
+		}
+		if path != dir {
+			skip, err := filter.skip(path, info.IsDir())
+			if err != nil {
+				return fmt.Errorf("%v: %w", path, err)
+			}
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if skip {
+				return nil
+			}
 		}
-		hdr := &tar.Header{
-			Name: tmplStr(path, ctx),
-			Mode: int64(info.Mode()),
-			Size: int64(len(contents)),
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			if path != dir {
+				pool.add(dirOrLinkFiles(tree, path, info, data, ctx))
+			}
+			return nil
 		}
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
+		if !info.Mode().IsRegular() || data.isDataFile(path) {
+			return nil
 		}
-		if _, err := tw.Write([]byte(contents)); err != nil {
-			return err
+		if *flagSuffix != "" && !strings.HasSuffix(path, *flagSuffix) {
+			pool.add(copiedFiles(tree, path, info, data, ctx))
+			return nil
 		}
-		return tw.Flush()
+		if !matchGlobs(textGlobs, path) {
+			binary := matchGlobs(binaryGlobs, path)
+			if !binary {
+				if binary, err = isBinaryFile(tree, path); err != nil {
+					pool.add(nil, err)
+					return nil
+				}
+			}
+			if binary {
+				binaries = append(binaries, path)
+				pool.add(copiedFiles(tree, path, info, data, ctx))
+				return nil
+			}
+		}
+		ctx, err := data.context(path, ctx)
+		if err != nil {
+			pool.add(nil, fmt.Errorf("%v: %w", path, err))
+			return nil
+		}
+		pool.render(path, info, ctx)
+		return nil
 	})
+	if err == errStopped {
+		err = nil
+	}
+	err = errors.Join(pool.wait(), err)
+	if len(binaries) > 0 {
+		noun := "files"
+		if len(binaries) == 1 {
+			noun = "file"
+		}
+		fmt.Fprintf(os.Stderr, "tmpl: copied %d binary %s without rendering (use -text to render):\n", len(binaries), noun)
+		for _, path := range binaries {
+			fmt.Fprintf(os.Stderr, "\t%v\n", path)
+		}
+	}
+	return err
+}
+
+// copiedFiles returns the file at path copied unchanged once for each name its path expands to,
+// like the rendered files next to it. Its contents are streamed from tree when written.
+func copiedFiles(tree sourceTree, path string, info os.FileInfo, data *dataFiles, ctx any) ([]renderedFile, error) {
+	ctx, err := data.context(path, ctx)
 	if err != nil {
-		return fmt.Errorf("issue recursing: %w", err)
+		return nil, fmt.Errorf("%v: %w", path, err)
 	}
-	if outPath == "-" {
-		_, err = io.Copy(os.Stdout, buf)
-		return err
+	expansions, err := expandPath(path, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%v: rendering path: %w", path, err)
+	}
+	var files []renderedFile
+	for _, x := range expansions {
+		files = append(files, renderedFile{name: x.name, mode: info.Mode(), src: path, tree: tree, info: info})
 	}
-	return extractTar(buf, outPath, stripN)
+	return files, nil
 }
 
-func extractTar(buf io.Reader, outPath string, stripN int) error {
-	tarReader := tar.NewReader(buf)
-	for true {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
+// dirOrLinkFiles returns the directory or symlink at path once for each name its path expands to.
+// A directory's name is rendered with the context of the files in it, so that it
+// expands the same way as their paths. A symlink's target is rendered with the same context as its name.
+func dirOrLinkFiles(tree sourceTree, path string, info os.FileInfo, data *dataFiles, ctx any) ([]renderedFile, error) {
+	ctxPath := path
+	if info.IsDir() {
+		ctxPath = filepath.Join(path, dirDataName)
+	}
+	ctx, err := data.context(ctxPath, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	expansions, err := expandPath(path, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%v: rendering path: %w", path, err)
+	}
+	var target string
+	if !info.IsDir() {
+		if target, err = tree.readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	var files []renderedFile
+	for _, x := range expansions {
+		f := renderedFile{name: x.name, mode: info.Mode(), info: info}
+		if !info.IsDir() {
+			targets, err := expandPath(target, x.ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%v: rendering link target: %w", path, err)
+			}
+			if len(targets) != 1 {
+				return nil, fmt.Errorf("%v: link target %q must render to a single path", path, target)
+			}
+			f.linkname = targets[0].name
 		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// renderPath renders the file at path once for each name its path expands to,
+// and returns the outputs followed by any files they emitted.
+// Front matter can skip an output or override its name and mode. The -suffix is stripped from output names.
+// Emitted files are placed next to the rendered path. A template that only emits
+// files and renders nothing else does not produce an output of its own.
+func renderPath(tree sourceTree, path string, info os.FileInfo, htmlMode bool, ctx any) ([]renderedFile, error) {
+	f, _, err := tree.open(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readPage(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	p.name = path
+	mode, err := p.mode()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if mode == 0 {
+		mode = info.Mode()
+	}
+	expansions, err := expandPath(path, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%v: rendering path: %w", path, err)
+	}
+	var files []renderedFile
+	for _, x := range expansions {
+		x.name = strings.TrimSuffix(x.name, *flagSuffix)
+		ctx, err := p.context(x.ctx)
 		if err != nil {
-			return fmt.Errorf("Next() failed: %w", err)
+			return nil, fmt.Errorf("%v: %w", path, err)
 		}
-		path := header.Name
-		parts := strings.Split(path, string(filepath.Separator))
-		toStrip := stripN
-		if toStrip >= len(parts) {
-			toStrip = len(parts) - 1
+		if skip, err := p.skip(ctx); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		} else if skip {
+			continue
 		}
-		if len(parts) > toStrip {
-			path = strings.Join(parts[toStrip:], string(filepath.Separator))
+		name, err := p.outputName(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
 		}
-		fullPath := filepath.Join(outPath, path)
-		if err := ensureEnclosingDir(fullPath); err != nil {
-			return fmt.Errorf("issue ensuring directory exists: %w", err)
+		if name != "" {
+			x.name = filepath.Join(filepath.Dir(x.name), name)
 		}
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.Mkdir(fullPath, 0755); err != nil {
-				return fmt.Errorf("Mkdir() failed: %w", err)
-			}
-		case tar.TypeReg:
-			outFile, err := os.Create(fullPath)
-			if err != nil {
-				return fmt.Errorf("Create() failed: %w", err)
+		buf := new(bytes.Buffer)
+		if err := p.execute(htmlMode, buf, ctx); err != nil {
+			return nil, err
+		}
+		main, emitted, err := splitFiles(buf.String())
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if len(emitted) == 0 || strings.TrimSpace(main) != "" {
+			files = append(files, renderedFile{name: x.name, mode: mode, contents: main, info: info})
+		}
+		for _, e := range emitted {
+			e.name = filepath.Join(filepath.Dir(x.name), e.name)
+			if e.mode == 0 {
+				e.mode = mode
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return fmt.Errorf("io.Copy() failed: %w", err)
+			e.info = info
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// chmodBits are the mode bits restored by extractor.
+const chmodBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// extractor writes tar entries under outPath, stripping stripN leading directories.
+// Directories, symlinks and file modes are restored, along with modification times and ownership with -mtime and -owner.
+type extractor struct {
+	outPath string
+	stripN  int
+	dirs    []extractedDir
+}
+
+type extractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// extract writes the entry described by header, with the contents in r.
+func (x *extractor) extract(header *tar.Header, r io.Reader) error {
+	path := strings.TrimSuffix(filepath.FromSlash(header.Name), string(filepath.Separator))
+	parts := strings.Split(path, string(filepath.Separator))
+	toStrip := x.stripN
+	if toStrip >= len(parts) {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+		toStrip = len(parts) - 1
+	}
+	path = strings.Join(parts[toStrip:], string(filepath.Separator))
+	fullPath, err := x.localPath(path)
+	if err != nil {
+		return err
+	}
+	if err := ensureEnclosingDir(fullPath); err != nil {
+		return fmt.Errorf("issue ensuring directory exists: %w", err)
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if info, err := os.Lstat(fullPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("extract: %v: path escapes the output directory through symlink %v", path, fullPath)
+		}
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			return fmt.Errorf("MkdirAll() failed: %w", err)
+		}
+		// Directories get their modes last, so that read-only ones can still be filled.
+		x.dirs = append(x.dirs, extractedDir{fullPath, header})
+		return nil
+	case tar.TypeReg:
+		// Replace a symlink left by an earlier run rather than writing through it.
+		if info, err := os.Lstat(fullPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(fullPath); err != nil {
+				return fmt.Errorf("Remove() failed: %w", err)
 			}
-			outFile.Close()
+		}
+		outFile, err := os.OpenFile(fullPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("OpenFile() failed: %w", err)
+		}
+		_, err = io.Copy(outFile, r)
+		if cerr := outFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("io.Copy() failed: %w", err)
+		}
+		if err := os.Chmod(fullPath, header.FileInfo().Mode()&chmodBits); err != nil {
+			return fmt.Errorf("Chmod() failed: %w", err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Remove() failed: %w", err)
+		}
+		if err := os.Symlink(header.Linkname, fullPath); err != nil {
+			return fmt.Errorf("Symlink() failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("extract: unknown type: %v in %v", header.Typeflag, header.Name)
+	}
+	return restoreAttrs(fullPath, header)
+}
+
+// localPath returns where the entry at path is written. So that the entries cannot write
+// outside outPath, path must be local and none of its parents under outPath may be a symlink.
+func (x *extractor) localPath(path string) (string, error) {
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("extract: %v: path escapes the output directory", path)
+	}
+	dir := x.outPath
+	parts := strings.Split(path, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("extract: %v: path escapes the output directory through symlink %v", path, dir)
+		}
+	}
+	return filepath.Join(x.outPath, path), nil
+}
 
-		default:
-			return fmt.Errorf("extractTar: uknown type: %v in %v", header.Typeflag, header.Name)
+// finish sets the modes and attributes of the extracted directories, deepest first.
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := os.Chmod(d.path, d.hdr.FileInfo().Mode()&chmodBits); err != nil {
+			return fmt.Errorf("Chmod() failed: %w", err)
+		}
+		if err := restoreAttrs(d.path, d.hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAttrs sets the ownership and, except for symlinks, the modification time of path from hdr,
+// with -owner and -mtime.
+func restoreAttrs(path string, hdr *tar.Header) error {
+	if *flagOwner {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("Lchown() failed: %w", err)
+		}
+	}
+	if *flagMtime && hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("Chtimes() failed: %w", err)
 		}
 	}
 	return nil
@@ -203,40 +834,66 @@ func ensureEnclosingDir(path string) error {
 	return os.MkdirAll(filepath.Dir(path), 0755)
 }
 
-func runDirTxtar(dir string, htmlMode bool, outPath string, stripN int, ctx any) error {
-	buf := new(bytes.Buffer)
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.Mode().IsRegular() {
+// writeTxtar writes the files produced by walk as a txtar archive to outPath.
+// Files are written as they are produced; if walk fails, the output holds the files written so far.
+func writeTxtar(walk walkFunc, outPath string, stripN int) error {
+	out, err := getOutput(outPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = walk(func(f renderedFile) error {
+		if f.mode.IsDir() {
 			return nil
 		}
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		contents, err := tmplToString(f, htmlMode, ctx)
-		if err != nil {
-			return fmt.Errorf("%v: %w", path, err)
+		if f.mode&os.ModeSymlink != 0 {
+			fmt.Fprintf(os.Stderr, "tmpl: txtar cannot hold symlinks, skipping %v\n", f.name)
+			return nil
 		}
-		name := tmplStr(path, ctx)
+		name := f.name
 		parts := strings.Split(name, string(filepath.Separator))
 		if stripN < len(parts) {
 			name = strings.Join(parts[stripN:], string(filepath.Separator))
 		}
-		fmt.Fprintf(buf, "-- %s --\n%s", name, contents)
-		if !strings.HasSuffix(contents, "\n") {
-			buf.WriteString("\n")
+		r, size, err := f.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		fmt.Fprintf(w, "-- %s --\n", name)
+		lw := &lastByteWriter{w: w}
+		if _, err := io.Copy(lw, io.LimitReader(r, size)); err != nil {
+			return err
+		}
+		if lw.last != '\n' {
+			return w.WriteByte('\n')
 		}
 		return nil
 	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("issue recursing: %w", err)
 	}
-	if outPath == "-" {
-		_, err = io.Copy(os.Stdout, buf)
-		return err
+	return nil
+}
+
+// lastByteWriter records the last byte written through it.
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.last = p[n-1]
 	}
-	return os.WriteFile(outPath, buf.Bytes(), 0644)
+	return n, err
 }
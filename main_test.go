@@ -1,9 +1,23 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func TestTmpl(t *testing.T) {
@@ -29,3 +43,1408 @@ func TestTmpl(t *testing.T) {
 		})
 	}
 }
+
+func TestStripBlocks(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		trim, lstrip bool
+		want         string
+	}{
+		{"off", "{{if .}}\nx\n{{end}}\n", false, false, "\nx\n\n"},
+		{"trim", "{{if .}}\nx\n{{end}}\n", true, false, "x\n"},
+		{"trim keeps pipelines", "{{len .}}\ny", true, false, "1\ny"},
+		{"lstrip", "a:\n  {{range .}}\n  - {{.}}\n  {{end}}\n", false, true, "a:\n\n  - a\n\n"},
+		{"both", "a:\n  {{range .}}\n  - {{.}}\n  {{end}}\n", true, true, "a:\n  - a\n"},
+		{"lstrip needs line start", "x {{if .}}y{{end}}", false, true, "x y"},
+		{"comment", "  {{/* }} */}}\nx", true, true, "x"},
+		{"quoted delimiter", "{{if ne \"}}\" \"\"}}\nx{{end}}", true, false, "x"},
+		{"trim markers", "  {{- if . -}}\nx{{end}}", true, true, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := stripBlocks(tt.src, "{{", "}}", tt.trim, tt.lstrip)
+			if got, want := strings.Count(src, "\n"), strings.Count(tt.src, "\n"); got != want {
+				t.Errorf("stripBlocks() has %d lines, want %d", got, want)
+			}
+			tmpl, err := template.New("").Parse(src)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, []string{"a"}); err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("rendered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTmplFiles(t *testing.T) {
+	const src = `head
+{{range .}}{{file (printf "%s.conf" .) "0600"}}name={{.}}
+{{end}}{{endfile}}tail
+`
+	contents, err := tmplToString(strings.NewReader(src), false, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("tmplToString() error = %v", err)
+	}
+	main, files, err := splitFiles(contents)
+	if err != nil {
+		t.Fatalf("splitFiles() error = %v", err)
+	}
+	if want := "head\ntail\n"; main != want {
+		t.Errorf("main = %q, want %q", main, want)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	for i, name := range []string{"a", "b"} {
+		f := files[i]
+		if f.name != name+".conf" || f.mode != 0600 || f.contents != "name="+name+"\n" {
+			t.Errorf("files[%d] = %+v", i, f)
+		}
+	}
+
+	_, err = tmplToString(strings.NewReader(`{{file "../x"}}`), false, nil)
+	if err == nil {
+		t.Errorf("expected error for non-local file name")
+	}
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.tmpl")
+	if err := os.WriteFile(in, []byte(`main{{file "sub/x.conf"}}x{{endfile}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(in, "-", "", false); err == nil || !strings.Contains(err.Error(), "needs -w") {
+		t.Errorf("run() to stdout error = %v, want needs -w", err)
+	}
+	if err := run(in, filepath.Join(dir, "out", "main.txt"), "", false); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for name, want := range map[string]string{"main.txt": "main", "sub/x.conf": "x"} {
+		if b, err := os.ReadFile(filepath.Join(dir, "out", name)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", name, b, err, want)
+		}
+	}
+
+	for name, files := range map[string]map[string]string{
+		"range": {"{{range .services}}{{.}}.conf{{end}}": `{{.item}}{{file "extra/x.txt"}}x{{endfile}}`},
+		"files": {"a.conf": `a{{file "x.conf"}}x{{endfile}}`, "x.conf": "x"},
+	} {
+		dir := t.TempDir()
+		for path, contents := range files {
+			if err := os.WriteFile(filepath.Join(dir, path), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx := map[string]any{"services": []string{"api", "web"}}
+		err := walkDir(osTree{}, dir, false, ctx, func(renderedFile) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "more than once") {
+			t.Errorf("%s: walkDir() error = %v, want output more than once", name, err)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	ctx := map[string]any{"services": []string{"api", "web"}, "env": "prod"}
+	tests := []struct {
+		name  string
+		path  string
+		want  []string
+		bound string
+	}{
+		{"plain", "a/b.conf", []string{"a/b.conf"}, ""},
+		{"value", "a/{{.env}}.conf", []string{"a/prod.conf"}, ""},
+		{"range", "a/{{range .services}}{{.}}.conf{{end}}", []string{"a/api.conf", "a/web.conf"}, "item"},
+		{"range var", "{{range $svc := .services}}{{$svc}}{{end}}/x.conf", []string{"api/x.conf", "web/x.conf"}, "svc"},
+		{"range empty", "{{range .missing}}{{.}}{{end}}.conf", nil, ""},
+		{"range else", "{{range .missing}}{{.}}{{else}}none{{end}}.conf", []string{"none.conf"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPath(tt.path, ctx)
+			if err != nil {
+				t.Fatalf("expandPath() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expandPath() = %v, want %v", got, tt.want)
+			}
+			for i, x := range got {
+				if x.name != tt.want[i] {
+					t.Errorf("name[%d] = %q, want %q", i, x.name, tt.want[i])
+				}
+				if tt.bound != "" && x.ctx.(map[string]any)[tt.bound] != ctx["services"].([]string)[i] {
+					t.Errorf("ctx[%d][%q] = %v", i, tt.bound, x.ctx.(map[string]any)[tt.bound])
+				}
+			}
+		})
+	}
+
+	if _, err := expandPath("{{.x | nosuchfunc}}", ctx); err == nil {
+		t.Errorf("expected error for bad path template")
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"data", "--- # tmpl\ndata:\n  replicas: 3\n---\nreplicas: {{.replicas}} user: {{.USER}}", "replicas: 3 user: test"},
+		{"delims", "--- # tmpl\ndelims: [\"[[\", \"]]\"]\n---\n[[.USER]] {{.USER}}", "test {{.USER}}"},
+		{"html", "--- # tmpl\nhtml: true\n---\n<p>{{\"<b>\"}}</p>", "<p>&lt;b&gt;</p>"},
+		{"empty", "--- # tmpl\n---\n{{.USER}}", "test"},
+		{"yaml document", "---\napiVersion: v1\n---\nkind: {{.USER}}", "---\napiVersion: v1\n---\nkind: test"},
+		{"yaml separators", "---\n---\nkind: {{.USER}}", "---\n---\nkind: test"},
+		{"yaml data key", "---\ndata:\n  key: v\n---\nkind: {{.USER}}", "---\ndata:\n  key: v\n---\nkind: test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tmplToString(strings.NewReader(tt.template), false, map[string]string{"USER": "test"})
+			if err != nil {
+				t.Fatalf("tmpl() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("tmpl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	p, err := parsePage("--- # tmpl\noutput: '{{.USER}}.conf'\nmode: 0755\nskip: '{{eq .USER \"skip\"}}'\n---\nbody")
+	if err != nil {
+		t.Fatalf("parsePage() error = %v", err)
+	}
+	if name, err := p.outputName(map[string]string{"USER": "test"}); err != nil || name != "test.conf" {
+		t.Errorf("outputName() = %q, %v", name, err)
+	}
+	if mode, err := p.mode(); err != nil || mode != 0755 {
+		t.Errorf("mode() = %o, %v", mode, err)
+	}
+	for user, want := range map[string]bool{"skip": true, "test": false} {
+		if skip, err := p.skip(map[string]string{"USER": user}); err != nil || skip != want {
+			t.Errorf("skip(%q) = %v, %v", user, skip, err)
+		}
+	}
+
+	for src, want := range map[string]string{
+		"--- # tmpl\noutput: x\nmdoe: 0755\n---\nbody": "line 3: field mdoe not found",
+		"--- # tmpl\noutput: x\n":                      "no closing ---",
+	} {
+		if _, err := parsePage(src); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parsePage(%q) error = %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"_data.yaml":      "env: prod\ndb:\n  host: db\n  port: 5432\n",
+		"a.conf":          "{{.env}} {{.db.host}}:{{.db.port}}",
+		"sub/_data.yaml":  "db:\n  host: sub-db\n",
+		"sub/b.conf":      "{{.env}} {{.db.host}}:{{.db.port}} {{.name}}",
+		"sub/b.conf.yaml": "name: b\n",
+		"sub/c.conf":      "{{.db.host}} {{.name}}",
+		"sub/orphan.yaml": "kept",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ensureEnclosingDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]string{}
+	err := walkDir(osTree{}, dir, false, map[string]string{"env": "ignored"}, func(f renderedFile) error {
+		if f.mode.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, f.name)
+		got[rel] = f.contents
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkDir() error = %v", err)
+	}
+	want := map[string]string{
+		"a.conf":          "prod db:5432",
+		"sub/b.conf":      "prod sub-db:5432 b",
+		"sub/c.conf":      "sub-db <no value>",
+		"sub/orphan.yaml": "kept",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkDir() = %v, want %v", got, want)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".tmplignore":         "# editor files\n*.swp\n/README.md\nbuild/\n!keep.swp\n",
+		".git/HEAD":           "ref",
+		"README.md":           "docs",
+		"a.conf":              "a",
+		"a.conf.swp":          "swap",
+		"keep.swp":            "kept",
+		"build/out":           "built",
+		"sub/.tmplignore":     "!*.swp\n*.md\n",
+		"sub/README.md":       "sub docs",
+		"sub/b.conf":          "b",
+		"sub/b.swp":           "swap",
+		"sub/deep/c.conf":     "c",
+		"sub/deep/c.tmp":      "tmp",
+		"sub/deep/build/file": "built",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ensureEnclosingDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		include, exclude stringsFlag
+		want             []string
+	}{
+		{want: []string{"a.conf", "keep.swp", "sub", "sub/b.conf", "sub/b.swp", "sub/deep", "sub/deep/c.conf", "sub/deep/c.tmp"}},
+		{exclude: stringsFlag{"*.tmp", "sub/deep/"}, want: []string{"a.conf", "keep.swp", "sub", "sub/b.conf", "sub/b.swp"}},
+		{include: stringsFlag{"*.conf"}, want: []string{"a.conf", "sub", "sub/b.conf", "sub/deep", "sub/deep/c.conf"}},
+		{include: stringsFlag{"sub/**/*.conf"}, exclude: stringsFlag{"b.*"}, want: []string{"sub", "sub/deep", "sub/deep/c.conf"}},
+	} {
+		*flagInclude, *flagExclude = tc.include, tc.exclude
+		var got []string
+		err := walkDir(osTree{}, dir, false, nil, func(f renderedFile) error {
+			rel, _ := filepath.Rel(dir, f.name)
+			got = append(got, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walkDir() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("walkDir(-include %v -exclude %v) = %v, want %v", tc.include, tc.exclude, got, tc.want)
+		}
+	}
+	*flagInclude, *flagExclude = nil, nil
+}
+
+func TestSuffix(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.conf.tmpl":          "port={{.port}}",
+		"main.go":                "var t = `{{.port}}`",
+		"chart/values.yaml":      "port: {{ .Values.port }}",
+		"{{.name}}/x.yaml.tmpl":  "name: {{.name}}",
+		"{{.name}}/README.md":    "# {{.name}}",
+		"app.conf.tmpl.yaml":     "port: 8080\n",
+		"scripts/run.sh.tmpl.md": "{{.port}}",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ensureEnclosingDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*flagSuffix = ".tmpl"
+	defer func() { *flagSuffix = "" }()
+	got := map[string]string{}
+	err := walkDir(osTree{}, dir, false, map[string]string{"name": "svc", "port": "80"}, func(f renderedFile) error {
+		if f.mode.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, f.name)
+		got[filepath.ToSlash(rel)] = readRendered(t, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkDir() error = %v", err)
+	}
+	want := map[string]string{
+		"app.conf":               "port=8080",
+		"main.go":                "var t = `{{.port}}`",
+		"chart/values.yaml":      "port: {{ .Values.port }}",
+		"svc/x.yaml":             "name: svc",
+		"svc/README.md":          "# {{.name}}",
+		"scripts/run.sh.tmpl.md": "{{.port}}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkDir() = %v, want %v", got, want)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+		want     bool
+	}{
+		{"text", "port={{.port}}\n", false},
+		{"utf8", "héllo {{.name}} ✓", false},
+		{"png", "\x89PNG\r\n\x1a\nrest", true},
+		{"pdf", "%PDF-1.7\n", true},
+		{"nul", "abc\x00def", true},
+		{"latin1", "caf\xe9", true},
+		{"empty", "", false},
+		{"latin1 after sniffLen", strings.Repeat("a", sniffLen) + "caf\xe9", false},
+		{"utf8 across sniffLen", strings.Repeat("a", sniffLen-1) + "é", false},
+		{"latin1 before sniffLen", strings.Repeat("a", sniffLen-3) + "\xe9ab", true},
+	} {
+		if got, err := isBinary(strings.NewReader(tc.contents)); err != nil || got != tc.want {
+			t.Errorf("isBinary(%s) = %v, %v, want %v", tc.name, got, err, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"logo.png":        "\x89PNG\r\n\x1a\n{{.x}}",
+		"a.conf":          "{{.x}}",
+		"blob.dat":        "{{.x}}",
+		"latin1.txt":      "{{.x}} caf\xe9",
+		"{{.x}}/icon.png": "\x89PNG\r\n\x1a\n{{.x}}",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ensureEnclosingDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*flagBinary, *flagText = stringsFlag{"*.dat"}, stringsFlag{"*.txt"}
+	defer func() { *flagBinary, *flagText = nil, nil }()
+	got := map[string]string{}
+	err := walkDir(osTree{}, dir, false, map[string]string{"x": "1"}, func(f renderedFile) error {
+		if f.mode.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, f.name)
+		got[filepath.ToSlash(rel)] = readRendered(t, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkDir() error = %v", err)
+	}
+	want := map[string]string{
+		"logo.png":   "\x89PNG\r\n\x1a\n{{.x}}",
+		"a.conf":     "1",
+		"blob.dat":   "{{.x}}",
+		"latin1.txt": "1 caf\xe9",
+		"1/icon.png": "\x89PNG\r\n\x1a\n{{.x}}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkDir() = %q, want %q", got, want)
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	for _, d := range []struct {
+		name string
+		mode os.FileMode
+	}{{"empty", 0755}, {"private", 0700}, {"{{.name}}", 0755}} {
+		if err := os.MkdirAll(filepath.Join(src, d.name), d.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []struct {
+		name, contents string
+		mode           os.FileMode
+	}{
+		{"entrypoint.sh", "#!/bin/sh\nexec {{.name}}\n", 0755},
+		{"private/key", "secret", 0600},
+		{"{{.name}}/config", "name={{.name}}", 0644},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(src, f.name), []byte(f.contents), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("{{.name}}/config", filepath.Join(src, "current")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "entrypoint.sh"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	*flagMtime = true
+	defer func() { *flagMtime = false }()
+
+	dst := t.TempDir()
+	stripN := len(strings.Split(src, string(filepath.Separator)))
+	if err := runDir(src, false, dst, stripN, false, map[string]string{"name": "app"}); err != nil {
+		t.Fatalf("runDir() error = %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"entrypoint.sh", 0755, "#!/bin/sh\nexec app\n"},
+		{"private", os.ModeDir | 0700, ""},
+		{"private/key", 0600, "secret"},
+		{"empty", os.ModeDir | 0755, ""},
+		{"app", os.ModeDir | 0755, ""},
+		{"app/config", 0644, "name=app"},
+		{"current", os.ModeSymlink | 0777, "app/config"},
+	} {
+		path := filepath.Join(dst, tc.name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if info.Mode() != tc.mode {
+			t.Errorf("%s: mode = %v, want %v", tc.name, info.Mode(), tc.mode)
+		}
+		var contents string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			contents, err = os.Readlink(path)
+		case info.Mode().IsRegular():
+			var b []byte
+			b, err = os.ReadFile(path)
+			contents = string(b)
+		}
+		if err != nil || contents != tc.contents {
+			t.Errorf("%s: contents = %q, %v, want %q", tc.name, contents, err, tc.contents)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "entrypoint.sh")); err != nil {
+		t.Error(err)
+	} else if !info.ModTime().Equal(mtime) {
+		t.Errorf("entrypoint.sh: mtime = %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestExtractEscape(t *testing.T) {
+	victim := t.TempDir()
+	tests := []struct {
+		name    string
+		files   map[string]string
+		symlink string // target of a symlink named "link", if any
+	}{
+		{"dotdot", map[string]string{`{{"../escaped.txt"}}`: "x"}, ""},
+		{"symlink", map[string]string{`{{"link"}}/pwned.txt`: "x"}, victim},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			for name, contents := range tt.files {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(src, name), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.symlink != "" {
+				if err := os.Symlink(tt.symlink, filepath.Join(src, "link")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dst := filepath.Join(t.TempDir(), "out")
+			stripN := len(strings.Split(src, string(filepath.Separator)))
+			err := runDir(src, false, dst, stripN, false, nil)
+			if err == nil || !strings.Contains(err.Error(), "escapes the output directory") {
+				t.Errorf("runDir() error = %v, want escape error", err)
+			}
+			for _, path := range []string{filepath.Join(filepath.Dir(dst), "escaped.txt"), filepath.Join(victim, "pwned.txt")} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Errorf("%s was written outside the output directory", path)
+				}
+			}
+		})
+	}
+}
+
+// readRendered returns the contents of f, reading copied files from disk.
+func readRendered(t *testing.T, f renderedFile) string {
+	t.Helper()
+	r, _, err := f.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriteTxtar(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "logo.svg")
+	if err := os.WriteFile(src, []byte("<svg/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	walk := func(emit func(renderedFile) error) error {
+		for _, f := range []renderedFile{
+			{name: "out/sub", mode: os.ModeDir | 0755},
+			{name: "out/a.conf", mode: 0644, contents: "a\n"},
+			{name: "out/logo.svg", mode: 0644, src: src, tree: osTree{}},
+			{name: "out/empty", mode: 0644},
+		} {
+			if err := emit(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	out := filepath.Join(dir, "out.txtar")
+	if err := writeTxtar(walk, out, 1); err != nil {
+		t.Fatalf("writeTxtar() error = %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- a.conf --\na\n-- logo.svg --\n<svg/>\n-- empty --\n\n"
+	if string(got) != want {
+		t.Errorf("writeTxtar() wrote %q, want %q", got, want)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 50 {
+		name := filepath.Join(dir, fmt.Sprintf("d%d", i%5), fmt.Sprintf("f%02d.txt", i))
+		contents := fmt.Sprintf("{{.name}} {{%d | add 1}} {{list 1 2 | toJson}}", i)
+		if i == 13 || i == 42 {
+			contents = "{{.name | nosuchfunc}}"
+		}
+		if err := ensureEnclosingDir(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(j int) { *flagJobs = j }(*flagJobs)
+	render := func(jobs int) ([]string, error) {
+		*flagJobs = jobs
+		var got []string
+		err := walkDir(osTree{}, dir, false, map[string]string{"name": "x"}, func(f renderedFile) error {
+			rel, _ := filepath.Rel(dir, f.name)
+			got = append(got, filepath.ToSlash(rel)+": "+f.contents)
+			return nil
+		})
+		return got, err
+	}
+	want, wantErr := render(1)
+	if len(want) != 5+48 {
+		t.Fatalf("walkDir(-j 1) emitted %d outputs, want %d", len(want), 5+48)
+	}
+	if wantErr == nil || !strings.Contains(wantErr.Error(), "f13.txt") || !strings.Contains(wantErr.Error(), "f42.txt") {
+		t.Fatalf("walkDir(-j 1) error = %v, want errors for f13.txt and f42.txt", wantErr)
+	}
+	for _, jobs := range []int{2, 8, 64} {
+		got, err := render(jobs)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("walkDir(-j %d) = %v, want %v", jobs, got, want)
+		}
+		if err == nil || err.Error() != wantErr.Error() {
+			t.Errorf("walkDir(-j %d) error = %v, want %v", jobs, err, wantErr)
+		}
+	}
+}
+
+func TestTxtarInput(t *testing.T) {
+	archive := `Scaffold for {{.name}}; this comment is not rendered.
+-- _data.yaml --
+port: 8080
+-- .tmplignore --
+*.md
+-- README.md --
+not shipped
+-- {{.name}}/config.yaml --
+name: {{.name}}
+port: {{.port}}
+-- {{.name}}/run.sh --
+exec {{.name}}
+-- bad/../../escape --
+`
+	if _, err := readTxtar(strings.NewReader(archive), int64(len(archive))); err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Errorf("readTxtar() error = %v, want invalid path", err)
+	}
+	archive = strings.TrimSuffix(archive, "-- bad/../../escape --\n")
+	dir := t.TempDir()
+	in := filepath.Join(dir, "scaffold.txtar")
+	if err := os.WriteFile(in, []byte(archive), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := "-- svc/config.yaml --\nname: svc\nport: 8080\n-- svc/run.sh --\nexec svc\n"
+	ctx := map[string]string{"name": "svc"}
+
+	out := filepath.Join(dir, "out.txtar")
+	if err := runDir(in, false, out, 0, true, ctx); err != nil {
+		t.Fatalf("runDir(%s) error = %v", in, err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != want {
+		t.Errorf("runDir(%s) wrote %q, %v, want %q", in, got, err, want)
+	}
+
+	stdin, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	os.Stdin = stdin
+	dst := filepath.Join(dir, "dst")
+	if err := runDir("-", false, dst, 0, false, ctx); err != nil {
+		t.Fatalf("runDir(-) error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "svc", "run.sh")); err != nil || string(got) != "exec svc\n" {
+		t.Errorf("runDir(-) wrote svc/run.sh = %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "README.md")); !os.IsNotExist(err) {
+		t.Errorf("runDir(-) wrote README.md despite .tmplignore: %v", err)
+	}
+}
+
+func TestArchiveInput(t *testing.T) {
+	type entry struct {
+		name, contents, link string
+		mode                 os.FileMode
+	}
+	entries := []entry{
+		{name: "bundle/", mode: os.ModeDir | 0755},
+		{name: "bundle/bin/", mode: os.ModeDir | 0700},
+		{name: "bundle/bin/start.sh", contents: "exec {{.name}}\n", mode: 0755},
+		{name: "bundle/{{.name}}.conf", contents: "name={{.name}}", mode: 0644},
+		{name: "bundle/current", link: "{{.name}}.conf", mode: os.ModeSymlink | 0777},
+	}
+	var tarBuf, zipBuf, gzBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	zw := zip.NewWriter(&zipBuf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: int64(e.mode.Perm()), Size: int64(len(e.contents)), Linkname: e.link}
+		switch {
+		case e.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case e.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, e.contents)
+		zh := &zip.FileHeader{Name: e.name}
+		zh.SetMode(e.mode)
+		w, err := zw.CreateHeader(zh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, e.contents+e.link)
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "bundle/bin/run.sh", Linkname: "bundle/bin/start.sh"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(tarBuf.Bytes())
+	gz.Close()
+
+	ctx := map[string]string{"name": "app"}
+	// Entries are in order of their source paths, so {{.name}}.conf comes last.
+	want := []string{
+		"bundle drwxr-xr-x",
+		"bundle/bin drwx------",
+		"bundle/bin/start.sh -rwxr-xr-x exec app\n",
+		"bundle/current Lrwxrwxrwx -> app.conf",
+		"bundle/app.conf -rw-r--r-- name=app",
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"tar", tarBuf.Bytes(), slices.Insert(slices.Clone(want), 2, "bundle/bin/run.sh -rwxr-xr-x exec app\n")},
+		{"tar.gz", gzBuf.Bytes(), slices.Insert(slices.Clone(want), 2, "bundle/bin/run.sh -rwxr-xr-x exec app\n")},
+		{"zip", zipBuf.Bytes(), want},
+	} {
+		tree, err := readArchive(bytes.NewReader(tc.data), int64(len(tc.data)))
+		if err != nil {
+			t.Errorf("readArchive(%s) error = %v", tc.name, err)
+			continue
+		}
+		defer tree.close()
+		var got []string
+		err = walkDir(tree, ".", false, ctx, func(f renderedFile) error {
+			line := f.name + " " + f.mode.String()
+			if f.linkname != "" {
+				line += " -> " + f.linkname
+			} else if !f.mode.IsDir() {
+				line += " " + readRendered(t, f)
+			}
+			got = append(got, line)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("walkDir(%s) error = %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("walkDir(%s) =\n%s\nwant\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+
+	stdin := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(stdin, gzBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	os.Stdin = f
+	dst := t.TempDir()
+	if err := runDir("-", false, dst, 1, false, ctx); err != nil {
+		t.Fatalf("runDir(-) error = %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "bin", "start.sh")); err != nil || info.Mode() != 0755 {
+		t.Errorf("runDir(-) wrote bin/start.sh: %v, %v", info, err)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	const defs = `{{define "card"}}[{{param "title"}}|{{param "size" "md"}}|{{slot "header"}}|{{slot}}]{{end}}`
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{"args and slots", `{{$x := "v"}}{{component "card" (dict "title" "T")}}{{fill "header"}}H{{endfill}}body {{$x}}{{endcomponent}}`, "[T|md|H|body v]", ""},
+		{"nested", `{{component "card" (dict "title" "a")}}{{component "card" (dict "title" "b" "size" "lg")}}in{{endcomponent}}{{endcomponent}}`, "[a|md||[b|lg||in]]", ""},
+		{"missing required", `{{component "card"}}x{{endcomponent}}`, "", `missing required argument "title"`},
+		{"missing end", `{{component "card" (dict "title" "T")}}x`, "", "missing endcomponent"},
+		{"slot outside", `{{slot}}`, "", "not inside a component"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tmplToString(strings.NewReader(defs+tt.template), false, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("tmpl() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tmpl() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("tmpl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvsubst(t *testing.T) {
+	ctx := map[string]string{"A": "a", "EMPTY": ""}
+	tests := []struct {
+		name    string
+		src     string
+		format  string
+		want    string
+		wantErr string
+	}{
+		{"plain", "$A ${A} $UNSET.", "", "a a .", ""},
+		{"default", "${UNSET-x} ${EMPTY-x} ${EMPTY:-x} ${A:-x}", "", "x  x a", ""},
+		{"alt", "${A+x} ${EMPTY+x} ${EMPTY:+x} ${UNSET+x}", "", "x x  ", ""},
+		{"nested", "${UNSET:-${A}-$A}", "", "a-a", ""},
+		{"escape", "$$A costs $5 $", "", "$A costs $5 $", ""},
+		{"shell format", "$A ${B:-b} $HOME", "$A ${B}", "a b $HOME", ""},
+		{"required", "x\n${EMPTY:?must be set}", "", "", "line 2: EMPTY: must be set"},
+		{"required unset", "${UNSET?}", "", "", "UNSET: parameter null or not set"},
+		{"bad substitution", "${A%x}", "", "", "bad substitution"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := parseShellFormat(tt.format)
+			if err != nil {
+				t.Fatalf("parseShellFormat() error = %v", err)
+			}
+			got, err := envsubst(tt.src, ctx, allowed)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("envsubst() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("envsubst() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("envsubst() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelm(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":             "apiVersion: v2\nname: demo\nversion: 0.1.0\n",
+		"values.yaml":            "replicas: 1\nimage:\n  repo: nginx\n",
+		"files/app.conf":         "conf\n",
+		"templates/_helpers.tpl": `{{define "demo.name"}}{{.Release.Name}}-{{.Chart.Name}}{{end}}`,
+		"templates/a.yaml":       `name: {{include "demo.name" .}} replicas: {{.Values.replicas}} image: {{.Values.image.repo}} tag: {{.Values.image.tag}} conf: {{.Files.Get "files/app.conf" | trim}} q: {{.Values.replicas | quote}} sq: {{squote .Values.image.repo 1}}`,
+		"templates/empty.yaml":   "{{if .Values.nope}}x{{end}}\n",
+		"templates/NOTES.txt":    "notes",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := ensureEnclosingDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := loadHelmChart(dir)
+	if err != nil {
+		t.Fatalf("loadHelmChart() error = %v", err)
+	}
+	if err := helmSet(c.values, "replicas=3,image.tag=v2"); err != nil {
+		t.Fatalf("helmSet() error = %v", err)
+	}
+	var got []renderedFile
+	err = c.render(func(f renderedFile) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("render() produced %d files, want 1: %v", len(got), got)
+	}
+	want := "name: release-name-demo replicas: 3 image: nginx tag: v2 conf: conf q: \"3\" sq: 'nginx' '1'"
+	if got[0].name != filepath.Join("demo", "templates", "a.yaml") || got[0].contents != want {
+		t.Errorf("render() = %q: %q, want %q", got[0].name, got[0].contents, want)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		template string
+		lenient  string
+		wantErr  string
+	}{
+		{`{{atoi "x"}}`, "0", "invalid syntax"},
+		{`{{div 1 0}}`, "0", "division by zero"},
+		{`{{mod 1 0}}`, "0", "division by zero"},
+		{`{{b64dec "%"}}`, "illegal base64 data at input byte 0", "illegal base64"},
+		{`{{fromJson "{"}}`, "", "unexpected end of JSON input"},
+		{`{{toDate "x"}}`, "0001-01-01 00:00:00 +0000 UTC", "unable to convert"},
+		{`{{regexMatch "(" "x"}}`, "false", "missing closing )"},
+		{`{{int "1x"}}`, "0", "invalid syntax"},
+	}
+	defer func(v bool) { *flagStrict = v }(*flagStrict)
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			*flagStrict = false
+			got, err := tmplToString(strings.NewReader(tt.template), false, nil)
+			if err != nil || got != tt.lenient {
+				t.Errorf("lenient tmpl() = %q, %v, want %q", got, err, tt.lenient)
+			}
+			*flagStrict = true
+			_, err = tmplToString(strings.NewReader(tt.template), false, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("strict tmpl() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		trim, lstrip bool
+		want         []string
+	}{
+		{"exec", "--- # tmpl\ndata: {a: 1}\n---\nfirst\n  port: {{ .a.b }}", false, false, []string{
+			"app.conf.tmpl:5:", "    5 |   port: {{ .a.b }}", "which has no field b",
+		}},
+		{"parse", "{{ toYAML . }}", false, false, []string{
+			"app.conf.tmpl:1: function \"toYAML\" not defined", `hint: did you mean "toYaml"?`,
+		}},
+		{"caret", "{{ upper 1 }}", false, false, []string{
+			"app.conf.tmpl:1:10:", "    1 | {{ upper 1 }}\n      |          ^",
+		}},
+		{"field chain", "--- # tmpl\ndata: {a: {b: 1}}\n---\n{{ .a.b.c }}", false, false, []string{
+			"app.conf.tmpl:4:4:", "    4 | {{ .a.b.c }}\n      |    ^",
+		}},
+		{"variable chain", "{{ $x := dict \"b\" 1 }}{{ upper $x.b }}", false, false, []string{
+			"app.conf.tmpl:1:32:", "    1 | {{ $x := dict \"b\" 1 }}{{ upper $x.b }}\n      |                                ^",
+		}},
+		{"trimblocks", "{{if true}}\n{{ upper 1 }}{{end}}", true, false, []string{
+			"app.conf.tmpl:2:10:", "    2 | {{ upper 1 }}{{end}}\n      |          ^",
+		}},
+		{"lstripblocks", "{{if true}}\n  {{if true}}{{ upper 1 }}{{end}}{{end}}", true, true, []string{
+			"app.conf.tmpl:2:23:", "    2 |   {{if true}}{{ upper 1 }}{{end}}{{end}}\n      |                       ^",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*flagTrimBlocks, *flagLstripBlocks = tt.trim, tt.lstrip
+			defer func() { *flagTrimBlocks, *flagLstripBlocks = false, false }()
+			p, err := parsePage(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.name = "app.conf.tmpl"
+			ctx, err := p.context(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.execute(false, new(bytes.Buffer), ctx)
+			if err == nil {
+				t.Fatal("execute() succeeded, want error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("execute() error = %q, want to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string // rules reported, in order
+		helm     bool
+	}{
+		{`{{.A}}`, nil, false},
+		{`{{.A | uper}}`, []string{"unknown-func"}, false},
+		{`{{now}} {{randAlpha 3}}`, []string{"non-hermetic", "non-hermetic"}, false},
+		{`{{env "HOME"}}`, []string{"env-call"}, false},
+		{`{{date_modify "1h" .T}}`, []string{"deprecated-alias"}, false},
+		{`{{define "x"}}x{{end}}`, []string{"unused-define"}, false},
+		{`{{define "x"}}x{{end}}{{template "x"}}`, nil, false},
+		{"{{if .A}}\nx\n{{end}}", []string{"whitespace", "whitespace"}, false},
+		{"{{- if .A}}\nx\n{{end -}}", nil, false},
+		{`{{.A}} {{.B.C}} {{range .A}}{{.Z}}{{end}}`, []string{"schema-field"}, false},
+		{`{{if}}`, []string{"parse"}, false},
+		{`{{range .A}}{{$.Z}}{{$.A}}{{end}}`, []string{"schema-field"}, false},
+		{`{{define "x"}}{{$.Z}}{{end}}{{template "x" .A}}`, nil, false},
+		{`{{include "x" .}} {{tpl "y" .}} {{required "z" .A}} {{toYaml .A}} {{quote 1}}`, []string{"unknown-func", "unknown-func", "unknown-func"}, false},
+		{`{{define "x"}}x{{end}}{{include "x" .}} {{tpl "y" .}} {{required "z" .A}} {{toYaml .A}} {{quote 1}}`, nil, true},
+		{`{{lookup "v1" "Pod" "ns" "x"}}`, []string{"non-hermetic"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			l := newLinter()
+			if tt.helm {
+				l.allowHelm()
+			}
+			l.schema = map[string]any{"A": nil, "T": nil}
+			p, err := parsePage(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.name = "t.tmpl"
+			l.lintPage(p)
+			var got []string
+			for _, d := range l.finish() {
+				got = append(got, d.Rule)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lint(%q) = %v, want %v", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintPositions(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string // line:column of the diagnostic
+	}{
+		{`x {{.B}}`, "1:5"},
+		{`x {{.B.C.D}}`, "1:5"},
+		{"x\n  {{if .A}}{{.A.B}}{{end}}", "2:14"},
+		{`{{uper .A}}`, "1:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			l := newLinter()
+			l.schema = map[string]any{"A": map[string]any{}}
+			p, err := parsePage(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.name = "t.tmpl"
+			l.lintPage(p)
+			diags := l.finish()
+			if len(diags) != 1 {
+				t.Fatalf("lint(%q) = %v, want one diagnostic", tt.template, diags)
+			}
+			if got := fmt.Sprintf("%d:%d", diags[0].Line, diags[0].Column); got != tt.want {
+				t.Errorf("lint(%q) %s at %s, want %s", tt.template, diags[0].Rule, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTemplate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{{.X}}`, `{{ .X }}`},
+		{`{{-   .X|printf "%s"   |upper -}}`, `{{- .X | printf "%s" | upper -}}`},
+		{`{{range $i,$v:=.A}}{{$v}}{{end}}`, `{{ range $i, $v := .A }}{{ $v }}{{ end }}`},
+		{`{{(index .A 1).B}}{{ ( len .A ) }}`, `{{ (index .A 1).B }}{{ (len .A) }}`},
+		{`{{/* comment */}}{{- /*x*/ -}}{{-3}}`, `{{/* comment */}}{{- /*x*/ -}}{{ -3 }}`},
+		{`{{"a|b"}} {{'x'}}`, `{{ "a|b" }} {{ 'x' }}`},
+		{"{{if .A}}\n{{- with .B}}\n    {{- .}}\n{{- end}}\n{{end}}", "{{ if .A }}\n  {{- with .B }}\n    {{- . }}\n  {{- end }}\n{{ end }}"},
+		{"{{if .A}}\n    x\n{{end}}", "{{ if .A }}\n    x\n{{ end }}"},
+		{"--- # tmpl\ndelims: ['<<', '>>']\n---\n<<.X>>", "--- # tmpl\ndelims: ['<<', '>>']\n---\n<< .X >>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := formatTemplate(tt.in, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("formatTemplate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if again, _ := formatTemplate(got, false); again != got {
+				t.Errorf("formatTemplate is not idempotent: %q", again)
+			}
+		})
+	}
+}
+
+func TestRepl(t *testing.T) {
+	ctx := map[string]any{"HOME": "/home/x", "cfg": map[string]any{"name": "a", "nested": map[string]any{"k": 1}}}
+	var out bytes.Buffer
+	r := &repl{ctx: ctx, out: &out}
+
+	evals := []struct {
+		in, want string
+	}{
+		{`.HOME | upper`, "/HOME/X\n"},
+		{`{{ .cfg.name }}-{{ dig "nested.k" .cfg }}`, "a-1\n"},
+		{`:ctx .cfg.nested`, "k: 1\n"},
+		{`:funcs trimSuf`, "trimSuffix\n"},
+		{`nope`, `error: repl:1: function "nope" not defined`},
+	}
+	for _, tt := range evals {
+		out.Reset()
+		r.eval(tt.in)
+		if !strings.HasPrefix(out.String(), tt.want) {
+			t.Errorf("eval(%q) = %q, want prefix %q", tt.in, out.String(), tt.want)
+		}
+	}
+	if !r.eval(":quit") {
+		t.Errorf("eval(:quit) did not quit")
+	}
+
+	completions := []struct {
+		line  string
+		start int
+		want  []string
+	}{
+		{"trimSuf", 0, []string{"trimSuffix"}},
+		{".cfg.n", 0, []string{".cfg.name", ".cfg.nested"}},
+		{"$.cfg.nested.", 0, []string{"$.cfg.nested.k"}},
+		{".HOME | upp", 8, []string{"upper"}},
+		{":fu", 0, []string{":funcs"}},
+		{".missing.x", 0, nil},
+	}
+	for _, tt := range completions {
+		start, got := r.complete(tt.line, len(tt.line))
+		if start != tt.start || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("complete(%q) = %d, %v, want %d, %v", tt.line, start, got, tt.start, tt.want)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	defer func(v bool, f string) { *flagTrace, *flagTraceFormat = v, f }(*flagTrace, *flagTraceFormat)
+	*flagTrace, *flagTraceFormat = true, "tree"
+	src := `{{ define "t" }}{{ . | upper }}{{ end -}}
+{{ if .A }}{{ .B | default "x" }}{{ else }}no{{ end }}
+{{ range .L }}{{ printf "%s=%s" . $.TOKEN }}{{ end }}
+{{ template "t" .B }}{{ .author }}`
+	ctx := map[string]any{"A": true, "B": "", "L": []any{"a"}, "TOKEN": "s3cret", "author": "ann"}
+	p := &page{body: src, name: "t.tmpl"}
+	tr := newTracer(p, false)
+	tmpl, err := template.New(p.name).Funcs(txtFuncMap()).Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tmpl.Templates() {
+		if err := tr.rewrite(tt.Tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out, trace bytes.Buffer
+	if err := tmpl.Funcs(tr.funcs()).Execute(&out, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "x\na=s3cret\nann"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	if err := tr.write(&trace); err != nil {
+		t.Fatal(err)
+	}
+	want := `trace: t.tmpl
+  t.tmpl:2:7: if .A => true (then)
+    t.tmpl:2:15: .B | default "x" => "x"
+        .B => ""
+  t.tmpl:3:10: range .L => [a] (1 iteration)
+    t.tmpl:3:18: printf "%s=%s" . $.TOKEN => [redacted]
+        $.TOKEN = [redacted]
+  t.tmpl:4:13: template "t" .B => ""
+    t.tmpl:1:20: . | upper => ""
+        . => ""
+  t.tmpl:4:25: .author => "ann"
+`
+	if trace.String() != want {
+		t.Errorf("trace:\n%s\nwant:\n%s", trace.String(), want)
+	}
+	for name, want := range map[string]bool{".auth": true, ".basic_auth": true, ".AUTH_HEADER": true, ".authToken": true, ".Authorization": true, ".author": false, ".Authority": false} {
+		if got := secretRE.MatchString(name); got != want {
+			t.Errorf("secretRE.MatchString(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCover(t *testing.T) {
+	defer func(v string) { *flagCover = v }(*flagCover)
+	*flagCover = filepath.Join(t.TempDir(), "cover.out")
+	coverage.blocks = nil
+	src := "{{ if .A }}a{{ .A }}{{ else if .B }}b{{ else }}c{{ end }}\n{{ range .L }}{{ . }}{{ else }}none{{ end }}"
+	for _, ctx := range []map[string]any{{"A": 1}, {"A": 1, "L": []int{1, 2}}} {
+		p := &page{body: src, name: "c.tmpl"}
+		if err := p.execute(false, new(bytes.Buffer), ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeCoverProfile(*flagCover); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(*flagCover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `mode: count
+c.tmpl:1.12,1.21 1 2
+c.tmpl:1.13,1.21 1 2
+c.tmpl:1.37,1.38 1 0
+c.tmpl:1.48,1.49 1 0
+c.tmpl:2.15,2.22 1 2
+c.tmpl:2.32,2.36 1 1
+`
+	if string(got) != want {
+		t.Errorf("profile:\n%s\nwant:\n%s", got, want)
+	}
+	html := annotateCoverage(src, mustReadCoverProfile(t, *flagCover))
+	if !strings.Contains(html, `{{ else if .B }}<span class="cov0">b</span>`) || !strings.Contains(html, `<span class="cov1">none</span>`) {
+		t.Errorf("annotateCoverage = %s", html)
+	}
+
+	// Positions are in the file as written, before -lstripblocks, and a file
+	// that cannot be read, such as one from an archive, does not fail the report.
+	*flagLstripBlocks = true
+	defer func() { *flagLstripBlocks = false }()
+	*flagCover = filepath.Join(t.TempDir(), "cover.out")
+	coverage.blocks = nil
+	p := &page{body: "x\n  {{ if .A }}a{{ end }}", name: "l.tmpl"}
+	if err := p.execute(false, new(bytes.Buffer), map[string]any{"A": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCoverProfile(*flagCover); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(*flagCover); err != nil || string(got) != "mode: count\nl.tmpl:2.14,2.15 1 1\n" {
+		t.Errorf("profile with -lstripblocks = %q, %v", got, err)
+	}
+	var b strings.Builder
+	if err := coverHTML(&b, *flagCover); err != nil || !strings.Contains(b.String(), "source not available") {
+		t.Errorf("coverHTML() error = %v, want the missing source reported in the page", err)
+	}
+}
+
+func mustReadCoverProfile(t *testing.T, path string) []*coverBlock {
+	t.Helper()
+	blocks, err := readCoverProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func TestLSP(t *testing.T) {
+	text := "{{ define \"greet\" }}hi{{ end }}\n{{ template \"greet\" . }}{{ .Values.na }}{{ uper .x }}\n{{ trimSuffix \"a\" }}"
+	requests := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.tmpl","text":` + strconv.Quote(text) + `}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/completion","params":{"textDocument":{"uri":"file:///a.tmpl"},"position":{"line":1,"character":36}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.tmpl"},"position":{"line":2,"character":5}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"textDocument/signatureHelp","params":{"textDocument":{"uri":"file:///a.tmpl"},"position":{"line":2,"character":18}}}`,
+		`{"jsonrpc":"2.0","id":5,"method":"textDocument/definition","params":{"textDocument":{"uri":"file:///a.tmpl"},"position":{"line":1,"character":15}}}`,
+		`{"jsonrpc":"2.0","id":6,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	}
+	var in, out bytes.Buffer
+	for _, r := range requests {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(r), r)
+	}
+	s := &lspServer{in: bufio.NewReader(&in), out: &out, docs: map[string]string{}}
+	s.schema = map[string]any{"Values": map[string]any{"name": nil, "nodes": nil, "port": nil}}
+	if err := s.serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]string{}
+	r := bufio.NewReader(&out)
+	for {
+		s := &lspServer{in: r}
+		msg, err := s.read()
+		if err != nil {
+			break
+		}
+		b, _ := json.Marshal(msg.Result)
+		key := msg.Method
+		if msg.ID != nil {
+			key = string(*msg.ID)
+		}
+		if msg.Params != nil {
+			b = msg.Params
+		}
+		responses[key] = string(b)
+	}
+	checks := []struct {
+		key  string
+		want []string
+	}{
+		{"1", []string{`"hoverProvider":true`, `"definitionProvider":true`}},
+		{"textDocument/publishDiagnostics", []string{`"code":"unknown-func"`, `function \"uper\" not defined; did you mean \"upper\"?`, `"start":{"line":1,"character":43}`}},
+		{"2", []string{`"label":"name"`, `"label":"nodes"`}},
+		{"3", []string{"trimSuffix(string, string) string", "Removes a suffix from a string"}},
+		{"4", []string{`"label":"trimSuffix(string, string) string"`, `"activeParameter":1`}},
+		{"5", []string{`"uri":"file:///a.tmpl"`, `"range":{"end":{"character":17,"line":0},"start":{"character":10,"line":0}}`}},
+		{"6", []string{"null"}},
+	}
+	for _, c := range checks {
+		for _, w := range c.want {
+			if !strings.Contains(responses[c.key], w) {
+				t.Errorf("response %s = %s, want it to contain %s", c.key, responses[c.key], w)
+			}
+		}
+	}
+	if strings.Contains(responses["2"], `"label":"port"`) {
+		t.Errorf("completion of .Values.na offered port: %s", responses["2"])
+	}
+}
+
+func TestFuncDocs(t *testing.T) {
+	for _, m := range []map[string]any{txtFuncMap(), fileFuncs(false), new(components).funcs(false)} {
+		for name := range m {
+			if sig, doc := funcDoc(name); sig == "" || doc == "" {
+				t.Errorf("funcDoc(%q) = %q, %q, want a signature and a description", name, sig, doc)
+			}
+		}
+	}
+	for name := range funcDocs {
+		if _, ok := builtinDocs[name]; ok {
+			t.Errorf("%s is documented in both builtinDocs and funcDocs", name)
+		}
+	}
+	if sig, doc := funcDoc("nosuchfunc"); sig != "" || doc != "" {
+		t.Errorf("funcDoc(nosuchfunc) = %q, %q, want none", sig, doc)
+	}
+}
+
+// benchTree writes a tree of n templates using common sprig functions under a temporary directory.
+func benchTree(b *testing.B, n int) string {
+	b.Helper()
+	dir := b.TempDir()
+	for i := range n {
+		path := filepath.Join(dir, fmt.Sprintf("svc%d", i%20), fmt.Sprintf("config%03d.yaml", i))
+		if err := ensureEnclosingDir(path); err != nil {
+			b.Fatal(err)
+		}
+		src := fmt.Sprintf(`name: {{.name | upper}}-%d
+image: {{.image | default "nginx" | quote}}
+port: {{add 8000 %d}}
+host: {{regexReplaceAll "[^a-z0-9]+" (lower .name) "-"}}
+valid: {{regexMatch "^[a-z]+$" .name}}
+{{- range $k, $v := dict "a" 1 "b" 2}}
+{{$k}}: {{$v | toJson}}
+{{- end}}
+`, i, i)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func BenchmarkWalkDir(b *testing.B) {
+	dir := benchTree(b, 500)
+	ctx := map[string]string{"name": "My Service"}
+	defer func(j int) { *flagJobs = j }(*flagJobs)
+	for _, jobs := range []int{1, 8} {
+		b.Run(fmt.Sprintf("j=%d", jobs), func(b *testing.B) {
+			*flagJobs = jobs
+			for b.Loop() {
+				err := walkDir(osTree{}, dir, false, ctx, func(renderedFile) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	p, err := parsePage(`{{.name | upper}} {{regexReplaceAll "[^a-z]+" .name "-"}} {{list 1 2 3 | toJson}}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := map[string]string{"name": "My Service"}
+	for _, html := range []bool{false, true} {
+		b.Run(fmt.Sprintf("html=%v", html), func(b *testing.B) {
+			for b.Loop() {
+				if err := p.execute(html, io.Discard, ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExpandPath(b *testing.B) {
+	ctx := map[string]any{"name": "svc", "envs": []string{"dev", "prod"}}
+	for b.Loop() {
+		if _, err := expandPath("deploy/{{range $env := .envs}}{{$env}}{{end}}/{{.name | lower}}.yaml", ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
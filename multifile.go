@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	htmltemplate "html/template"
+)
+
+// fileMarker introduces a file switch in rendered output.
+// It is followed by the file name and octal mode, each terminated by a NUL byte.
+// An empty name switches back to the template's own output.
+const fileMarker = "\x00tmpl:file\x00"
+
+// renderedFile is a single output produced by rendering a template.
+// Its mode may also describe a directory or, with linkname as the target, a symlink.
+type renderedFile struct {
+	name     string
+	mode     os.FileMode
+	contents string
+	src      string // if set, a file in tree copied as is, whose contents are read when written
+	tree     sourceTree
+	linkname string
+	info     os.FileInfo // the source file, if any, for -mtime and -owner
+}
+
+// open returns the contents of f and their size, streaming copied files from their tree.
+func (f renderedFile) open() (io.ReadCloser, int64, error) {
+	if f.src == "" {
+		return io.NopCloser(strings.NewReader(f.contents)), int64(len(f.contents)), nil
+	}
+	return f.tree.open(f.src)
+}
+
+// fileFuncs returns the functions that let a template emit additional files.
+func fileFuncs(htmlMode bool) map[string]any {
+	if htmlMode {
+		return map[string]any{
+			"file": func(name string, mode ...any) (htmltemplate.HTML, error) {
+				s, err := fileFunc(name, mode...)
+				return htmltemplate.HTML(s), err
+			},
+			"endfile": func() htmltemplate.HTML { return htmltemplate.HTML(endFileFunc()) },
+		}
+	}
+	return map[string]any{
+		"file":    fileFunc,
+		"endfile": endFileFunc,
+	}
+}
+
+// fileFunc starts a new output file; everything rendered until the next file or endfile call is written to it.
+// The optional mode is parsed with parseMode.
+func fileFunc(name string, mode ...any) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("file: empty name")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("file: %q is not a local path", name)
+	}
+	var m os.FileMode
+	if len(mode) > 1 {
+		return "", fmt.Errorf("file: expected at most one mode, got %d", len(mode))
+	}
+	if len(mode) == 1 {
+		var err error
+		if m, err = parseMode(mode[0]); err != nil {
+			return "", fmt.Errorf("file: %w", err)
+		}
+	}
+	return fmt.Sprintf("%s%s\x00%o\x00", fileMarker, name, m.Perm()), nil
+}
+
+// parseMode parses a file mode given as an integer (0755) or an octal string ("0755").
+func parseMode(v any) (os.FileMode, error) {
+	switch v := v.(type) {
+	case int:
+		return os.FileMode(v).Perm(), nil
+	case string:
+		n, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid mode %q: %w", v, err)
+		}
+		return os.FileMode(n).Perm(), nil
+	default:
+		return 0, fmt.Errorf("invalid mode type %T", v)
+	}
+}
+
+// endFileFunc switches output back to the template's own output.
+func endFileFunc() string {
+	return fileMarker + "\x00\x00"
+}
+
+// splitFiles separates rendered output into the template's own output and the files emitted with file.
+func splitFiles(contents string) (string, []renderedFile, error) {
+	chunks := strings.Split(contents, fileMarker)
+	main := chunks[0]
+	var files []renderedFile
+	seen := map[string]bool{}
+	for _, chunk := range chunks[1:] {
+		parts := strings.SplitN(chunk, "\x00", 3)
+		if len(parts) != 3 {
+			return "", nil, fmt.Errorf("malformed file marker")
+		}
+		name, body := parts[0], parts[2]
+		if name == "" {
+			main += body
+			continue
+		}
+		mode, err := strconv.ParseUint(parts[1], 8, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("malformed file marker: %w", err)
+		}
+		if seen[name] {
+			return "", nil, fmt.Errorf("file %q emitted more than once", name)
+		}
+		seen[name] = true
+		files = append(files, renderedFile{name: name, mode: os.FileMode(mode), contents: body})
+	}
+	return main, files, nil
+}
+
+// writeFiles writes files emitted by a template relative to dir.
+func writeFiles(dir string, files []renderedFile) error {
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ensureEnclosingDir(path); err != nil {
+			return fmt.Errorf("issue ensuring directory exists: %w", err)
+		}
+		mode := f.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := os.WriteFile(path, []byte(f.contents), mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// errStopped is returned from a walk once a renderPool has stopped emitting.
+var errStopped = errors.New("stopped")
+
+// renderJob is a path under a -r directory, with the outputs it produced once done is closed.
+type renderJob struct {
+	path  string
+	info  os.FileInfo
+	ctx   any
+	files []renderedFile
+	err   error
+	done  chan struct{}
+}
+
+// renderPool renders templates on -j workers and emits their outputs in the order
+// the paths were added, so the output does not depend on which worker finishes first.
+// Rendering errors are collected rather than stopping the walk; an error from emit stops it.
+type renderPool struct {
+	tree     sourceTree
+	htmlMode bool
+	emit     func(renderedFile) error
+	work     chan *renderJob
+	queue    chan *renderJob
+	stop     chan struct{}
+	workers  sync.WaitGroup
+	result   chan error
+}
+
+// newRenderPool starts n workers. At most a few jobs per worker are queued ahead of
+// the one being emitted, which bounds memory use.
+func newRenderPool(n int, tree sourceTree, htmlMode bool, emit func(renderedFile) error) *renderPool {
+	n = max(n, 1)
+	rp := &renderPool{
+		tree:     tree,
+		htmlMode: htmlMode,
+		emit:     emit,
+		work:     make(chan *renderJob),
+		queue:    make(chan *renderJob, 2*n),
+		stop:     make(chan struct{}),
+		result:   make(chan error, 1),
+	}
+	for range n {
+		rp.workers.Add(1)
+		go func() {
+			defer rp.workers.Done()
+			for j := range rp.work {
+				j.files, j.err = renderPath(rp.tree, j.path, j.info, rp.htmlMode, j.ctx)
+				close(j.done)
+			}
+		}()
+	}
+	go rp.emitInOrder()
+	return rp
+}
+
+// render queues the template at path to be rendered with ctx.
+func (rp *renderPool) render(path string, info os.FileInfo, ctx any) {
+	j := &renderJob{path: path, info: info, ctx: ctx, done: make(chan struct{})}
+	rp.queue <- j
+	rp.work <- j
+}
+
+// add queues outputs that need no rendering, or the error producing them.
+func (rp *renderPool) add(files []renderedFile, err error) {
+	j := &renderJob{files: files, err: err, done: make(chan struct{})}
+	close(j.done)
+	rp.queue <- j
+}
+
+// stopped reports whether emit has failed, after which nothing more is emitted.
+func (rp *renderPool) stopped() bool {
+	select {
+	case <-rp.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the queued jobs and returns their errors, joined in queue order.
+func (rp *renderPool) wait() error {
+	close(rp.work)
+	rp.workers.Wait()
+	close(rp.queue)
+	return <-rp.result
+}
+
+// emitInOrder emits the outputs of each job once it is done, in queue order.
+// Two outputs with the same name are an error, as the second would overwrite the first.
+func (rp *renderPool) emitInOrder() {
+	var errs []error
+	seen := map[string]bool{}
+	for j := range rp.queue {
+		<-j.done
+		if rp.stopped() {
+			continue
+		}
+		if j.err != nil {
+			errs = append(errs, j.err)
+			continue
+		}
+		for _, f := range j.files {
+			if !f.mode.IsDir() {
+				if seen[f.name] {
+					errs = append(errs, fmt.Errorf("file %q is output more than once", f.name))
+					continue
+				}
+				seen[f.name] = true
+			}
+			if err := rp.emit(f); err != nil {
+				errs = []error{err}
+				close(rp.stop)
+				break
+			}
+		}
+	}
+	rp.result <- errors.Join(errs...)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Markers written while rendering a path with a top-level range action.
+// Neither can appear in a valid path.
+const (
+	pathItemMarker = "\x00"
+	pathEndMarker  = "\x01"
+)
+
+// pathExpansion is an output path produced by rendering a source path,
+// together with the context its contents are rendered with.
+type pathExpansion struct {
+	name string
+	ctx  any
+}
+
+// expandPath renders the template in path. A top-level range action fans the
+// path out into one expansion per element, cookiecutter-style: the element is
+// bound in the context under the range variable's name ({{range $svc := .services}}
+// binds .svc) or under "item" if no variable is declared.
+// With -syntax=envsubst, the path is expanded with envsubst instead.
+func expandPath(path string, ctx any) ([]pathExpansion, error) {
+	if *flagSyntax == "envsubst" {
+		allowed, err := parseShellFormat(*flagShellFormat)
+		if err != nil {
+			return nil, err
+		}
+		name, err := envsubst(path, ctx, allowed)
+		if err != nil {
+			return nil, err
+		}
+		return []pathExpansion{{name: name, ctx: ctx}}, nil
+	}
+	if !strings.Contains(path, "{{") {
+		return []pathExpansion{{name: path, ctx: ctx}}, nil
+	}
+	var items []any
+	funcs := template.FuncMap{
+		"tmplPathItem": func(v any) string {
+			items = append(items, v)
+			return pathItemMarker
+		},
+		"tmplPathEnd": func() string { return pathEndMarker },
+	}
+	t, err := newTxtTemplate("path").Funcs(funcs).Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	t = t.Option(fmt.Sprintf("missingkey=%s", *flagMissingKey))
+
+	root := t.Tree.Root
+	var rng *parse.RangeNode
+	at := 0
+	for i, n := range root.Nodes {
+		if r, ok := n.(*parse.RangeNode); ok {
+			if rng != nil {
+				return nil, fmt.Errorf("only one top-level range is supported in a path")
+			}
+			rng, at = r, i
+		}
+	}
+	if rng != nil {
+		item, err := parseAction("{{tmplPathItem .}}", funcs)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseAction("{{tmplPathEnd}}", funcs)
+		if err != nil {
+			return nil, err
+		}
+		rng.List.Nodes = append([]parse.Node{item}, rng.List.Nodes...)
+		root.Nodes = slices.Insert(root.Nodes, at+1, end)
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, ctx); err != nil {
+		return nil, err
+	}
+	out := b.String()
+	if rng == nil {
+		return []pathExpansion{{name: out, ctx: ctx}}, nil
+	}
+
+	i := strings.Index(out, pathEndMarker)
+	body, suffix := out[:i], out[i+len(pathEndMarker):]
+	if len(items) == 0 {
+		if rng.ElseList == nil {
+			return nil, nil
+		}
+		return []pathExpansion{{name: body + suffix, ctx: ctx}}, nil
+	}
+	parts := strings.Split(body, pathItemMarker)
+	prefix, names := parts[0], parts[1:]
+	key := "item"
+	if decl := rng.Pipe.Decl; len(decl) > 0 {
+		key = strings.TrimPrefix(decl[len(decl)-1].Ident[0], "$")
+	}
+	result := make([]pathExpansion, len(items))
+	for i, item := range items {
+		c, err := withValues(ctx, map[string]any{key: item})
+		if err != nil {
+			return nil, err
+		}
+		result[i] = pathExpansion{name: prefix + names[i] + suffix, ctx: c}
+	}
+	return result, nil
+}
+
+// parseAction parses src, which must consist of a single action, into a node.
+func parseAction(src string, funcs template.FuncMap) (parse.Node, error) {
+	t, err := template.New("action").Funcs(funcs).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return t.Tree.Root.Nodes[0], nil
+}
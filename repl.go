@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// replCommands are the commands understood by tmpl repl, with their help text.
+var replCommands = [][2]string{
+	{":ctx [.path]", "show the context keys, or the value at path as YAML"},
+	{":funcs [prefix]", "list the available functions"},
+	{":history", "show the input history"},
+	{":help", "show this help"},
+	{":quit", "exit (also Ctrl-D)"},
+}
+
+// repl evaluates template snippets against a fixed context.
+type repl struct {
+	ctx      any
+	htmlMode bool
+	history  []string
+	histFile string // "" disables saving history
+	out      io.Writer
+}
+
+// runRepl implements the repl subcommand and returns the exit code.
+func runRepl(args []string) int {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpl repl [flags]\n\nEvaluates template snippets interactively against the environment and data files.\n\n")
+		fs.PrintDefaults()
+	}
+	var data stringsFlag
+	fs.Var(&data, "data", "A YAML or JSON data file merged into the context (may be repeated)")
+	dir := fs.String("r", "", "If provided, merge the data files (_data.yaml) of this directory into the context, as -r would")
+	htmlMode := fs.Bool("html", false, "If true, use html/template instead of text/template")
+	fs.BoolVar(flagStrict, "strict", *flagStrict, "If true, use the erroring variants of lenient functions, as with tmpl -strict")
+	fs.StringVar(flagMissingKey, "missingkey", *flagMissingKey, "Controls behavior if a map is indexed with a key that is not present. Valid values are: default, zero, error")
+	home, _ := os.UserHomeDir()
+	histFile := fs.String("history", filepath.Join(home, ".tmpl_history"), "File to load and save input history; empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, err := replContext(*dir, data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl repl:", err)
+		return 1
+	}
+	r := &repl{ctx: ctx, htmlMode: *htmlMode, histFile: *histFile, out: os.Stdout}
+	r.loadHistory()
+	if err := r.run(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "tmpl repl:", err)
+		return 1
+	}
+	return 0
+}
+
+// replContext builds the context run would: the environment, the data files of dir and each data file.
+func replContext(dir string, data []string) (any, error) {
+	var ctx any = envMap()
+	if dir != "" {
+		var err error
+		if ctx, err = newDataFiles(dir).context(filepath.Join(dir, "-"), ctx); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range data {
+		v, err := loadData(path)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+		}
+		if ctx, err = withValues(ctx, v); err != nil {
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
+
+// run reads and evaluates lines from in until EOF or :quit.
+func (r *repl) run(in *os.File) error {
+	lr := &lineReader{in: bufio.NewReader(in), fd: int(in.Fd()), out: r.out, complete: r.complete}
+	if restore, err := makeRaw(lr.fd); err == nil {
+		restore()
+		lr.raw = true
+		fmt.Fprintln(r.out, `tmpl repl: type a template or an expression such as .HOME | upper; :help for commands`)
+	}
+	for {
+		lr.history = r.history
+		line, err := lr.readLine("tmpl> ")
+		for err == nil && strings.HasSuffix(line, `\`) {
+			var more string
+			more, err = lr.readLine("...   ")
+			line = strings.TrimSuffix(line, `\`) + "\n" + more
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		r.addHistory(strings.TrimSpace(line))
+		if quit := r.eval(line); quit {
+			return nil
+		}
+	}
+}
+
+// eval evaluates one input and prints the result. It reports whether the REPL should exit.
+func (r *repl) eval(line string) bool {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, ":") {
+		return r.command(line)
+	}
+	out, err := r.render(line)
+	if err != nil {
+		fmt.Fprintln(r.out, "error:", err)
+		return false
+	}
+	fmt.Fprintln(r.out, out)
+	return false
+}
+
+// render executes src against the context. Input without an action is treated as one,
+// so .HOME | upper is the same as {{ .HOME | upper }}.
+func (r *repl) render(src string) (string, error) {
+	if !strings.Contains(src, "{{") {
+		src = "{{ " + src + " }}"
+	}
+	p := &page{body: src, name: "repl"}
+	var b bytes.Buffer
+	err := p.execute(r.htmlMode, &b, r.ctx)
+	return b.String(), err
+}
+
+func (r *repl) command(line string) bool {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case ":q", ":quit", ":exit":
+		return true
+	case ":help":
+		for _, c := range replCommands {
+			fmt.Fprintf(r.out, "  %-16s %s\n", c[0], c[1])
+		}
+		fmt.Fprintln(r.out, "  End a line with \\ to continue it. Tab completes functions and context keys.")
+	case ":ctx":
+		v, ok := lookupPath(r.ctx, splitPath(arg))
+		if !ok {
+			fmt.Fprintf(r.out, "error: %s is not in the context\n", arg)
+			return false
+		}
+		if arg == "" {
+			for _, k := range mapKeys(v) {
+				val, _ := lookupPath(v, []string{k})
+				fmt.Fprintf(r.out, "  .%-24s %s\n", k, summarize(val))
+			}
+			return false
+		}
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+		r.out.Write(b)
+	case ":funcs":
+		var names []string
+		for _, name := range knownFuncs() {
+			if strings.HasPrefix(name, arg) {
+				names = append(names, name)
+			}
+		}
+		r.out.Write([]byte(columns(names, 80)))
+	case ":history":
+		for i, h := range r.history {
+			fmt.Fprintf(r.out, "%5d  %s\n", i+1, h)
+		}
+	default:
+		fmt.Fprintf(r.out, "error: unknown command %s; try :help\n", cmd)
+	}
+	return false
+}
+
+// complete returns the candidates for the word ending at pos in line and the offset where the word starts.
+func (r *repl) complete(line string, pos int) (int, []string) {
+	start := pos
+	for start > 0 && !strings.ContainsRune(" \t(|{", rune(line[start-1])) {
+		start--
+	}
+	word := line[start:pos]
+	var candidates []string
+	switch {
+	case start == 0 && strings.HasPrefix(word, ":"):
+		for _, c := range replCommands {
+			if name, _, _ := strings.Cut(c[0], " "); strings.HasPrefix(name, word) {
+				candidates = append(candidates, name)
+			}
+		}
+	case strings.HasPrefix(word, ".") || strings.HasPrefix(word, "$."):
+		i := strings.LastIndexByte(word, '.')
+		v, ok := lookupPath(r.ctx, splitPath(strings.TrimPrefix(word[:i], "$")))
+		if !ok {
+			return start, nil
+		}
+		for _, k := range mapKeys(v) {
+			if strings.HasPrefix(k, word[i+1:]) {
+				candidates = append(candidates, word[:i+1]+k)
+			}
+		}
+	default:
+		for _, name := range knownFuncs() {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	return start, candidates
+}
+
+// splitPath splits a field path such as .a.b into its keys.
+func splitPath(path string) []string {
+	path = strings.Trim(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// lookupPath returns the value at keys in v, descending through maps with string keys.
+func lookupPath(v any, keys []string) (any, bool) {
+	for _, k := range keys {
+		switch m := v.(type) {
+		case map[string]any:
+			next, ok := m[k]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case map[string]string:
+			next, ok := m[k]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// mapKeys returns the sorted keys of v if it is a map with string keys.
+func mapKeys(v any) []string {
+	var keys []string
+	switch m := v.(type) {
+	case map[string]any:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// summarize returns a one-line description of v for :ctx.
+func summarize(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return fmt.Sprintf("map (%d keys)", len(v))
+	case []any:
+		return fmt.Sprintf("list (%d items)", len(v))
+	}
+	s := fmt.Sprintf("%q", fmt.Sprint(v))
+	if len(s) > 48 {
+		s = s[:45] + "..."
+	}
+	return s
+}
+
+// columns lays out words in columns no wider than width.
+func columns(words []string, width int) string {
+	w := 0
+	for _, s := range words {
+		w = max(w, len(s)+2)
+	}
+	perLine := max(1, width/max(w, 1))
+	var b strings.Builder
+	for i, s := range words {
+		b.WriteString(s)
+		if (i+1)%perLine == 0 || i == len(words)-1 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(strings.Repeat(" ", w-len(s)))
+		}
+	}
+	return b.String()
+}
+
+func (r *repl) loadHistory() {
+	if r.histFile == "" {
+		return
+	}
+	b, err := os.ReadFile(r.histFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line != "" {
+			r.history = append(r.history, strings.ReplaceAll(line, `\n`, "\n"))
+		}
+	}
+	const maxHistory = 1000
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+}
+
+func (r *repl) addHistory(line string) {
+	if n := len(r.history); n > 0 && r.history[n-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if r.histFile == "" {
+		return
+	}
+	f, err := os.OpenFile(r.histFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, strings.ReplaceAll(line, "\n", `\n`))
+}
+
+// lineReader reads lines from a terminal with basic editing, history and tab completion,
+// or plain lines when the input is not a terminal.
+type lineReader struct {
+	in       *bufio.Reader
+	fd       int
+	raw      bool // the input is a terminal
+	out      io.Writer
+	history  []string
+	complete func(line string, pos int) (int, []string)
+	restore  func()
+}
+
+func (lr *lineReader) restoreTerm() {
+	if lr.restore != nil {
+		lr.restore()
+		lr.restore = nil
+	}
+}
+
+// readLine prints prompt and returns the next line, without its newline.
+func (lr *lineReader) readLine(prompt string) (string, error) {
+	if !lr.raw {
+		line, err := lr.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := makeRaw(lr.fd)
+	if err != nil {
+		return "", err
+	}
+	lr.restore = restore
+	defer lr.restoreTerm()
+
+	var buf []rune
+	pos, hist := 0, len(lr.history)
+	redraw := func() {
+		fmt.Fprintf(lr.out, "\r\x1b[K%s%s", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Fprintf(lr.out, "\x1b[%dD", n)
+		}
+	}
+	redraw()
+	for {
+		c, _, err := lr.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			io.WriteString(lr.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			io.WriteString(lr.out, "^C\r\n")
+			buf, pos = nil, 0
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				io.WriteString(lr.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+		case '\t':
+			buf, pos = lr.completeAt(buf, pos)
+		case 27: // escape sequence
+			if b, _ := lr.in.ReadByte(); b != '[' && b != 'O' {
+				continue
+			}
+			switch b, _ := lr.in.ReadByte(); b {
+			case 'A', 'B':
+				if b == 'A' && hist > 0 {
+					hist--
+				} else if b == 'B' && hist < len(lr.history) {
+					hist++
+				}
+				buf = nil
+				if hist < len(lr.history) {
+					buf = []rune(lr.history[hist])
+				}
+				pos = len(buf)
+			case 'C':
+				pos = min(pos+1, len(buf))
+			case 'D':
+				pos = max(pos-1, 0)
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '3':
+				if b, _ := lr.in.ReadByte(); b == '~' && pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if c >= ' ' && c != utf8.RuneError {
+				buf = append(buf[:pos], append([]rune{c}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// completeAt completes the word before pos, inserting the longest common prefix
+// of the candidates and listing them if there are several.
+func (lr *lineReader) completeAt(buf []rune, pos int) ([]rune, int) {
+	line := string(buf[:pos])
+	start, candidates := lr.complete(line, len(line))
+	if len(candidates) == 0 {
+		return buf, pos
+	}
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(candidates) > 1 && len(prefix) <= len(line)-start {
+		io.WriteString(lr.out, "\r\n"+strings.ReplaceAll(columns(candidates, 80), "\n", "\r\n"))
+	}
+	if len(candidates) == 1 && !strings.HasPrefix(prefix, ":") && !strings.Contains(prefix, ".") {
+		prefix += " "
+	}
+	rest := buf[pos:]
+	head := []rune(line[:start] + prefix)
+	return append(head, rest...), len(head)
+}
@@ -27,6 +27,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -54,6 +56,9 @@ func genericFuncMap() map[string]interface{} {
 		"must_date_modify": mustDateModify,
 		"mustDateModify":   mustDateModify,
 		"mustToDate":       mustToDate,
+		"mustDate":         mustDate,
+		"mustDateInZone":   mustDateInZone,
+		"mustDuration":     mustDuration,
 		"now":              time.Now,
 		"toDate":           toDate,
 		"unixEpoch":        unixEpoch,
@@ -114,6 +119,11 @@ func genericFuncMap() map[string]interface{} {
 		"seq":       seq,
 		"toDecimal": toDecimal,
 
+		"mustAtoi":    mustAtoi,
+		"mustInt64":   mustToInt64,
+		"mustInt":     mustToInt,
+		"mustFloat64": mustToFloat64,
+
 		// String array functions
 		"split":     split,
 		"splitList": func(sep, orig string) []string { return strings.Split(orig, sep) },
@@ -148,6 +158,8 @@ func genericFuncMap() map[string]interface{} {
 			}
 			return toInt64(a) % bv
 		},
+		"mustDiv": mustDiv,
+		"mustMod": mustMod,
 		"mul":     mul,
 		"randInt": func(min, max int) int { return min + 1 }, // deterministic for testing
 		"add1f":   add1f,
@@ -227,6 +239,9 @@ func genericFuncMap() map[string]interface{} {
 		"b32enc": base32encode,
 		"b32dec": base32decode,
 
+		"mustB64dec": mustBase64decode,
+		"mustB32dec": mustBase32decode,
+
 		// Data Structures
 		"tuple":              list,
 		"list":               list,
@@ -297,6 +312,7 @@ func genericFuncMap() map[string]interface{} {
 		// SemVer
 		"semver":        semverFunc,
 		"semverCompare": semverCompare,
+		"mustSemver":    mustSemver,
 
 		// Comparison
 		"eq": eq, "ne": ne, "lt": lt, "le": le, "gt": gt, "ge": ge,
@@ -325,6 +341,9 @@ func genericFuncMap() map[string]interface{} {
 		// URLs
 		"urlParse": urlParse,
 		"urlJoin":  urlJoin,
+
+		"mustUrlParse": mustUrlParse,
+		"mustUrlJoin":  mustUrlJoin,
 	}
 }
 
@@ -2141,17 +2160,46 @@ func semverCompare(constraint, version string) bool {
 }
 
 // Regex
+
+// regexCache holds compiled regular expressions by source. Templates usually
+// call the regex functions with a few literal patterns, once per file or loop iteration.
+var regexCache sync.Map
+
+// regexCacheSize counts the cached expressions, which are capped at
+// maxCachedRegexps so that patterns built from data cannot grow the cache without bound.
+var regexCacheSize atomic.Int64
+
+const maxCachedRegexps = 1000
+
+func compileRegex(regex string) (*regexp.Regexp, error) {
+	if r, ok := regexCache.Load(regex); ok {
+		return r.(*regexp.Regexp), nil
+	}
+	r, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	if regexCacheSize.Add(1) <= maxCachedRegexps {
+		regexCache.Store(regex, r)
+	}
+	return r, nil
+}
+
 func regexMatch(regex string, s string) bool {
-	matched, _ := regexp.MatchString(regex, s)
+	matched, _ := mustRegexMatch(regex, s)
 	return matched
 }
 
 func mustRegexMatch(regex string, s string) (bool, error) {
-	return regexp.MatchString(regex, s)
+	r, err := compileRegex(regex)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchString(s), nil
 }
 
 func regexFindAll(regex string, s string, n int) []string {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return nil
 	}
@@ -2159,7 +2207,7 @@ func regexFindAll(regex string, s string, n int) []string {
 }
 
 func mustRegexFindAll(regex string, s string, n int) ([]string, error) {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return nil, err
 	}
@@ -2167,7 +2215,7 @@ func mustRegexFindAll(regex string, s string, n int) ([]string, error) {
 }
 
 func regexFind(regex string, s string) string {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return ""
 	}
@@ -2175,7 +2223,7 @@ func regexFind(regex string, s string) string {
 }
 
 func mustRegexFind(regex string, s string) (string, error) {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return "", err
 	}
@@ -2183,7 +2231,7 @@ func mustRegexFind(regex string, s string) (string, error) {
 }
 
 func regexReplaceAll(regex string, s string, repl string) string {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return s
 	}
@@ -2191,7 +2239,7 @@ func regexReplaceAll(regex string, s string, repl string) string {
 }
 
 func mustRegexReplaceAll(regex string, s string, repl string) (string, error) {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return "", err
 	}
@@ -2199,7 +2247,7 @@ func mustRegexReplaceAll(regex string, s string, repl string) (string, error) {
 }
 
 func regexReplaceAllLiteral(regex string, s string, repl string) string {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return s
 	}
@@ -2207,7 +2255,7 @@ func regexReplaceAllLiteral(regex string, s string, repl string) string {
 }
 
 func mustRegexReplaceAllLiteral(regex string, s string, repl string) (string, error) {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return "", err
 	}
@@ -2215,7 +2263,7 @@ func mustRegexReplaceAllLiteral(regex string, s string, repl string) (string, er
 }
 
 func regexSplit(regex string, s string, n int) []string {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return []string{s}
 	}
@@ -2223,7 +2271,7 @@ func regexSplit(regex string, s string, n int) []string {
 }
 
 func mustRegexSplit(regex string, s string, n int) ([]string, error) {
-	r, err := regexp.Compile(regex)
+	r, err := compileRegex(regex)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +34,19 @@ func HermeticHtmlFuncMap() htmltemplate.FuncMap {
 	return htmltemplate.FuncMap(hermeticFuncMap())
 }
 
+// StrictTxtFuncMap returns a function map for text templates in which functions
+// that fall back to a zero value on bad input (atoi, toDate, fromJson, b64dec,
+// div by zero, ...) are replaced by their erroring must variants.
+func StrictTxtFuncMap() template.FuncMap {
+	return template.FuncMap(strictFuncMap())
+}
+
+// StrictHtmlFuncMap returns a function map for HTML templates with the same
+// replacements as StrictTxtFuncMap.
+func StrictHtmlFuncMap() htmltemplate.FuncMap {
+	return htmltemplate.FuncMap(strictFuncMap())
+}
+
 // GenericFuncMap returns a copy of the basic function map as a map[string]interface{}.
 func GenericFuncMap() map[string]interface{} {
 	return genericFuncMap()
@@ -0,0 +1,158 @@
+package sprig
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// strictAliases maps functions whose erroring variant is not simply "must" + name.
+var strictAliases = map[string]string{
+	"date_in_zone": "mustDateInZone",
+	"date_modify":  "mustDateModify",
+	"toDecimal":    "mustFloat64",
+	"toInt":        "mustInt",
+}
+
+// strictFuncMap returns the function map with every function that has an
+// erroring variant replaced by it, so bad input fails the render instead of
+// producing a zero value or an error string.
+func strictFuncMap() map[string]interface{} {
+	all := genericFuncMap()
+	for name := range all {
+		must, ok := strictAliases[name]
+		if !ok {
+			must = "must" + strings.ToUpper(name[:1]) + name[1:]
+		}
+		if f, ok := all[must]; ok {
+			all[name] = f
+		}
+	}
+	return all
+}
+
+func mustAtoi(a string) (int, error) {
+	return strconv.Atoi(a)
+}
+
+func mustToInt64(v interface{}) (int64, error) {
+	switch s := v.(type) {
+	case string:
+		return strconv.ParseInt(s, 10, 64)
+	case int, int64, int32, int16, int8, uint, uint64, uint32, uint16, uint8, float64, float32:
+		return toInt64(v), nil
+	default:
+		return 0, fmt.Errorf("unable to convert %T to int64", v)
+	}
+}
+
+func mustToInt(v interface{}) (int, error) {
+	i, err := mustToInt64(v)
+	return int(i), err
+}
+
+func mustToFloat64(v interface{}) (float64, error) {
+	switch s := v.(type) {
+	case string:
+		return strconv.ParseFloat(s, 64)
+	case float64, float32, int64, int, uint64:
+		return toFloat64(v), nil
+	default:
+		return 0, fmt.Errorf("unable to convert %T to float64", v)
+	}
+}
+
+func mustDiv(a, b interface{}) (int64, error) {
+	bv := toInt64(b)
+	if bv == 0 {
+		return 0, fmt.Errorf("div: division by zero")
+	}
+	return toInt64(a) / bv, nil
+}
+
+func mustMod(a, b interface{}) (int64, error) {
+	bv := toInt64(b)
+	if bv == 0 {
+		return 0, fmt.Errorf("mod: division by zero")
+	}
+	return toInt64(a) % bv, nil
+}
+
+func mustBase64decode(v string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(v)
+	return string(data), err
+}
+
+func mustBase32decode(v string) (string, error) {
+	data, err := base32.StdEncoding.DecodeString(v)
+	return string(data), err
+}
+
+func mustDate(fmt string, date interface{}) (string, error) {
+	t, err := mustToDate(date)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(fmt), nil
+}
+
+func mustDateInZone(fmt string, date interface{}, zone string) (string, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return "", err
+	}
+	t, err := mustToDate(date)
+	if err != nil {
+		return "", err
+	}
+	return t.In(loc).Format(fmt), nil
+}
+
+func mustDuration(v interface{}) (time.Duration, error) {
+	switch t := v.(type) {
+	case string:
+		if d, err := time.ParseDuration(t); err == nil {
+			return d, nil
+		}
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", t)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	case int64, int, time.Duration:
+		return duration(v), nil
+	default:
+		return 0, fmt.Errorf("unable to convert %T to time.Duration", v)
+	}
+}
+
+func mustSemver(version string) (map[string]interface{}, error) {
+	v := semverFunc(version)
+	if v == nil {
+		return nil, fmt.Errorf("invalid semantic version %q", version)
+	}
+	return v, nil
+}
+
+func mustUrlParse(u string) (map[string]interface{}, error) {
+	if _, err := url.Parse(u); err != nil {
+		return nil, err
+	}
+	return urlParse(u), nil
+}
+
+func mustUrlJoin(base string, ref string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
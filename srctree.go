@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sourceTree is the tree of templates rendered with -r: a directory, or an archive.
+type sourceTree interface {
+	// walk calls fn for root and everything under it in lexical order, like filepath.Walk.
+	walk(root string, fn filepath.WalkFunc) error
+	// open returns the contents of the regular file at path and its size.
+	open(path string) (io.ReadCloser, int64, error)
+	// stat returns the file info of path, following symlinks.
+	stat(path string) (os.FileInfo, error)
+	// readlink returns the target of the symlink at path.
+	readlink(path string) (string, error)
+	// close releases the files backing the tree.
+	close() error
+}
+
+// archiveSuffixes are the file name suffixes of archives that -r reads instead of treating as a directory.
+var archiveSuffixes = []string{".txtar", ".tar", ".tar.gz", ".tgz", ".zip"}
+
+// openSourceTree returns the tree named by -r and the root to walk in it.
+// "-" reads an archive from stdin, as does a file named like one of archiveSuffixes; anything else is a directory.
+func openSourceTree(path string) (sourceTree, string, error) {
+	if path == "-" {
+		tree, err := readStdinArchive(os.Stdin)
+		if err != nil {
+			return nil, "", fmt.Errorf("stdin: %w", err)
+		}
+		return tree, ".", nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || !slices.ContainsFunc(archiveSuffixes, func(s string) bool { return strings.HasSuffix(path, s) }) {
+		return osTree{}, path, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	tree, err := readArchive(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("%v: %w", path, err)
+	}
+	tree.closers = append(tree.closers, f.Close)
+	return tree, ".", nil
+}
+
+// archiveHeaderLen is how much of an archive archiveFormat needs to see.
+const archiveHeaderLen = 262
+
+// archiveFormat returns the format of the archive starting with head: "tar", "tar.gz", "zip" or "txtar".
+func archiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		return "tar.gz"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case len(head) >= archiveHeaderLen && string(head[257:262]) == "ustar":
+		return "tar"
+	}
+	return "txtar"
+}
+
+// readArchive reads a tar, gzipped tar, zip or txtar archive, telling them apart by their contents.
+// Only the index of the entries is held in memory: zip and txtar entries are read from r when
+// opened, and the contents of tar entries, which can only be read in order, are copied to a temporary file.
+func readArchive(r io.ReaderAt, size int64) (*memTree, error) {
+	head := make([]byte, min(size, archiveHeaderLen))
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	switch format := archiveFormat(head); format {
+	case "zip":
+		return readZip(r, size)
+	case "txtar":
+		return readTxtar(r, size)
+	default:
+		return readTarFormat(format, io.NewSectionReader(r, 0, size))
+	}
+}
+
+// readStdinArchive reads an archive like readArchive from r, which need not be seekable.
+// A tar is read as it arrives; a zip or txtar is first copied to a temporary file.
+func readStdinArchive(r io.Reader) (*memTree, error) {
+	br := bufio.NewReaderSize(r, archiveHeaderLen)
+	head, err := br.Peek(archiveHeaderLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if format := archiveFormat(head); format == "tar" || format == "tar.gz" {
+		return readTarFormat(format, br)
+	}
+	f, err := os.CreateTemp("", "tmpl-")
+	if err != nil {
+		return nil, err
+	}
+	remove := func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, br)
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	tree, err := readArchive(f, size)
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	tree.closers = append(tree.closers, remove)
+	return tree, nil
+}
+
+// osTree reads a -r directory from the file system.
+type osTree struct{}
+
+func (osTree) walk(root string, fn filepath.WalkFunc) error { return filepath.Walk(root, fn) }
+
+func (osTree) open(path string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (osTree) stat(path string) (os.FileInfo, error) { return os.Stat(path) }
+
+func (osTree) readlink(path string) (string, error) { return os.Readlink(path) }
+
+func (osTree) close() error { return nil }
+
+// memTree is a source tree read from an archive, keyed by cleaned relative path with "." as the root.
+// Directories are created for the parents of every entry.
+type memTree struct {
+	files   map[string]*memFile
+	closers []func() error // release the files the entries are read from
+}
+
+// memFile is an entry of a memTree. It implements os.FileInfo.
+type memFile struct {
+	name     string
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	contents func() (io.ReadCloser, error) // nil for an empty file
+	linkname string
+	sys      any
+}
+
+func (f *memFile) Name() string       { return filepath.Base(f.name) }
+func (f *memFile) Size() int64        { return f.size }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFile) Sys() any           { return f.sys }
+
+// section returns the contents of a file stored in r at off.
+func section(r io.ReaderAt, off, n int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(r, off, n)), nil
+	}
+}
+func newMemTree() *memTree {
+	return &memTree{files: map[string]*memFile{".": {name: ".", mode: os.ModeDir | 0755}}}
+}
+
+// add adds f under the slash-separated name, which must be local to the tree, creating its parent directories.
+// A directory may be added over one created for an earlier entry, to set its mode.
+func (t *memTree) add(name string, f *memFile) error {
+	name = filepath.Clean(filepath.FromSlash(strings.TrimSuffix(name, "/")))
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("invalid path %q", name)
+	}
+	if old, ok := t.files[name]; ok && !(old.IsDir() && f.IsDir()) {
+		return fmt.Errorf("duplicate path %q", name)
+	}
+	f.name = name
+	t.files[name] = f
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if d, ok := t.files[dir]; ok {
+			if !d.IsDir() {
+				return fmt.Errorf("%q is both a file and a directory", dir)
+			}
+			continue
+		}
+		t.files[dir] = &memFile{name: dir, mode: os.ModeDir | 0755, modTime: f.modTime}
+	}
+	return nil
+}
+
+func (t *memTree) lstat(path string) (*memFile, error) {
+	f, ok := t.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (t *memTree) walk(root string, fn filepath.WalkFunc) error {
+	children := map[string][]string{}
+	for name := range t.files {
+		if name != "." {
+			dir := filepath.Dir(name)
+			children[dir] = append(children[dir], name)
+		}
+	}
+	var walk func(f *memFile) error
+	walk = func(f *memFile) error {
+		if err := fn(f.name, f, nil); err != nil || !f.IsDir() {
+			return err
+		}
+		names := children[f.name]
+		slices.Sort(names)
+		for _, name := range names {
+			c := t.files[name]
+			if err := walk(c); err != nil && !(err == filepath.SkipDir && c.IsDir()) {
+				return err
+			}
+		}
+		return nil
+	}
+	f, err := t.lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	if err := walk(f); err != filepath.SkipDir && err != filepath.SkipAll {
+		return err
+	}
+	return nil
+}
+
+func (t *memTree) open(path string) (io.ReadCloser, int64, error) {
+	fi, err := t.stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		return nil, 0, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("is a directory")}
+	}
+	f := fi.(*memFile)
+	if f.contents == nil {
+		return io.NopCloser(strings.NewReader("")), 0, nil
+	}
+	r, err := f.contents()
+	if err != nil {
+		return nil, 0, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return r, f.size, nil
+}
+
+func (t *memTree) stat(path string) (os.FileInfo, error) {
+	f, err := t.lstat(path)
+	for range 40 {
+		if err != nil || f.mode&os.ModeSymlink == 0 {
+			return f, err
+		}
+		target := f.linkname
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(f.name), target)
+		}
+		f, err = t.lstat(target)
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: fmt.Errorf("too many levels of symbolic links")}
+}
+
+func (t *memTree) readlink(path string) (string, error) {
+	f, err := t.lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if f.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: fmt.Errorf("not a symlink")}
+	}
+	return f.linkname, nil
+}
+
+func (t *memTree) close() error {
+	var errs []error
+	for _, c := range t.closers {
+		errs = append(errs, c())
+	}
+	t.closers = nil
+	return errors.Join(errs...)
+}
+
+// readTxtar reads a txtar archive: an optional comment, then files each
+// introduced by a "-- name --" line and holding the lines up to the next one.
+func readTxtar(r io.ReaderAt, size int64) (*memTree, error) {
+	t := newMemTree()
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	var f *memFile
+	var start, off int64
+	end := func() {
+		if f != nil {
+			f.size, f.contents = off-start, section(r, start, off-start)
+		}
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if name, ok := txtarMarker(line); ok {
+			end()
+			f = &memFile{mode: 0644}
+			if err := t.add(name, f); err != nil {
+				return nil, err
+			}
+			start = off + int64(len(line))
+		}
+		off += int64(len(line))
+	}
+	end()
+	return t, nil
+}
+
+// txtarMarker returns the file name of a "-- name --" line.
+func txtarMarker(line []byte) (string, bool) {
+	s := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	if !strings.HasPrefix(s, "-- ") || !strings.HasSuffix(s, " --") || len(s) < len("-- x --") {
+		return "", false
+	}
+	name := strings.TrimSpace(s[len("-- ") : len(s)-len(" --")])
+	return name, name != ""
+}
+
+// readTarFormat reads a tar, or a gzipped tar if format is "tar.gz".
+func readTarFormat(format string, r io.Reader) (*memTree, error) {
+	if format == "tar.gz" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return readTar(r)
+}
+
+// readTar reads a tar archive, copying the contents of its files to a temporary file.
+// Hard links become copies of their targets, and the headers are kept so that
+// -owner carries the archive's ownership through.
+func readTar(r io.Reader) (_ *memTree, err error) {
+	t := newMemTree()
+	defer func() {
+		if err != nil {
+			t.close()
+		}
+	}()
+	var spool *os.File
+	var off int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := &memFile{mode: hdr.FileInfo().Mode(), modTime: hdr.ModTime, sys: hdr}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if spool == nil {
+				if spool, err = os.CreateTemp("", "tmpl-"); err != nil {
+					return nil, err
+				}
+				t.closers = append(t.closers, func() error {
+					spool.Close()
+					return os.Remove(spool.Name())
+				})
+			}
+			n, err := io.Copy(spool, tr)
+			if err != nil {
+				return nil, err
+			}
+			f.size, f.contents = n, section(spool, off, n)
+			off += n
+		case tar.TypeDir:
+		case tar.TypeSymlink:
+			f.linkname = hdr.Linkname
+		case tar.TypeLink:
+			target, err := t.lstat(filepath.FromSlash(hdr.Linkname))
+			if err != nil || !target.mode.IsRegular() {
+				return nil, fmt.Errorf("%v: hard link to missing file %v", hdr.Name, hdr.Linkname)
+			}
+			f.mode, f.size, f.contents = target.mode, target.size, target.contents
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return nil, fmt.Errorf("%v: unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err := t.add(hdr.Name, f); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readZip reads a zip archive, including symlinks stored with their target as contents.
+func readZip(r io.ReaderAt, size int64) (*memTree, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	t := newMemTree()
+	for _, zf := range zr.File {
+		f := &memFile{mode: zf.Mode(), modTime: zf.Modified}
+		switch {
+		case f.mode&os.ModeSymlink != 0:
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", zf.Name, err)
+			}
+			target, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", zf.Name, err)
+			}
+			f.linkname = string(target)
+		case !f.IsDir():
+			f.size, f.contents = int64(zf.UncompressedSize64), zf.Open
+		}
+		if err := t.add(zf.Name, f); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// makeRaw is not supported on this platform; the REPL falls back to reading plain lines.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode not supported")
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// secretRE matches the names of fields and variables whose values are redacted from traces.
+// auth must be a whole word, so that author and authority are not redacted.
+var secretRE = regexp.MustCompile(`(?i)(passw(or)?d|passwd|secret|token|api_?key|private_?key|credential|(^|[^a-z])auth(orization)?($|[^a-z]))`)
+
+// traceSite is an action, control structure or template call in the parsed
+// templates that records trace events when executed.
+type traceSite struct {
+	pos    string // name:line:col
+	kind   string // "action", "if", "with", "range" or "template"
+	text   string
+	depth  int      // static nesting depth within its template
+	args   []string // expressions of the traced arguments
+	stages []string // all but the last command of the pipeline
+}
+
+// traceEvent is one execution of a traceSite.
+type traceEvent struct {
+	Pos    string       `json:"pos"`
+	Kind   string       `json:"kind"`
+	Text   string       `json:"text"`
+	Depth  int          `json:"depth"`
+	Args   []traceValue `json:"args,omitempty"`
+	Stages []traceValue `json:"stages,omitempty"`
+	Result string       `json:"result"`
+	Branch string       `json:"branch,omitempty"`
+}
+
+// traceValue is an expression and its value.
+type traceValue struct {
+	Expr  string `json:"expr"`
+	Value string `json:"value"`
+}
+
+// tracer records the execution of a page for -trace.
+type tracer struct {
+	page    *page
+	html    bool
+	sites   []traceSite
+	events  []*traceEvent
+	pending map[int]*traceEvent // events whose pipeline is still being evaluated
+	base    []int               // nesting depth of the enclosing template calls
+}
+
+// newTracer returns a tracer for p, or nil if -trace is not set.
+func newTracer(p *page, htmlMode bool) *tracer {
+	if !*flagTrace {
+		return nil
+	}
+	return &tracer{page: p, html: htmlMode, pending: map[int]*traceEvent{}}
+}
+
+// funcs returns the functions called by the rewritten templates.
+// Each passes its last argument through unchanged.
+func (tr *tracer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"tmplTraceArg": func(id, i int, v any) any {
+			ev := tr.event(id)
+			ev.Args = append(ev.Args, traceValue{tr.sites[id].args[i], tr.format(tr.sites[id].args[i], v)})
+			return v
+		},
+		"tmplTraceStage": func(id, i int, v any) any {
+			ev := tr.event(id)
+			ev.Stages = append(ev.Stages, traceValue{tr.sites[id].stages[i], tr.format(tr.sites[id].stages[i], v)})
+			return v
+		},
+		"tmplTrace": func(id int, v any) any {
+			ev := tr.finish(id)
+			ev.Result = tr.format(tr.sites[id].text, v)
+			return v
+		},
+		"tmplTraceCond": func(id int, v any) any {
+			ev := tr.finish(id)
+			ev.Result = tr.format(tr.sites[id].text, v)
+			ev.Branch = traceBranch(ev.Kind, v)
+			return v
+		},
+		"tmplTraceCall": func(id int, v ...any) any {
+			ev := tr.finish(id)
+			tr.base = append(tr.base, ev.Depth+1)
+			if len(v) == 0 {
+				// Called as an action before a template call without data.
+				ev.Result = "nil"
+				return ""
+			}
+			ev.Result = tr.format(tr.sites[id].text, v[0])
+			return v[0]
+		},
+		"tmplTracePop": func() string {
+			tr.base = tr.base[:len(tr.base)-1]
+			return ""
+		},
+	}
+}
+
+// event returns the pending event for site id, creating it if needed.
+func (tr *tracer) event(id int) *traceEvent {
+	if ev, ok := tr.pending[id]; ok {
+		return ev
+	}
+	s := tr.sites[id]
+	ev := &traceEvent{Pos: s.pos, Kind: s.kind, Text: s.text, Depth: s.depth}
+	if n := len(tr.base); n > 0 {
+		ev.Depth += tr.base[n-1]
+	}
+	tr.pending[id] = ev
+	return ev
+}
+
+// finish records the pending event for site id.
+func (tr *tracer) finish(id int) *traceEvent {
+	ev := tr.event(id)
+	delete(tr.pending, id)
+	tr.events = append(tr.events, ev)
+	return ev
+}
+
+// traceBranch describes which branch of a control structure v selects.
+func traceBranch(kind string, v any) string {
+	if kind == "range" {
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map, reflect.String, reflect.Chan:
+			return iterations(rv.Len())
+		case reflect.Int, reflect.Int64:
+			return iterations(int(rv.Int()))
+		}
+		return ""
+	}
+	if truth, _ := template.IsTrue(v); truth {
+		return "then"
+	}
+	return "else"
+}
+
+func iterations(n int) string {
+	switch {
+	case n <= 0:
+		return "else"
+	case n == 1:
+		return "1 iteration"
+	}
+	return fmt.Sprintf("%d iterations", n)
+}
+
+// format returns v for display, redacting it if expr names a secret.
+func (tr *tracer) format(expr string, v any) string {
+	if secretRE.MatchString(expr) {
+		return "[redacted]"
+	}
+	var s string
+	switch v := redactValue(v).(type) {
+	case nil:
+		s = "nil"
+	case string:
+		s = strconv.Quote(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if len(s) > 120 {
+		s = s[:117] + "..."
+	}
+	return s
+}
+
+// redactValue returns a copy of v with the values of secret-named map keys redacted.
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			if secretRE.MatchString(k) {
+				m[k] = "[redacted]"
+			} else {
+				m[k] = redactValue(val)
+			}
+		}
+		return m
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for k, val := range v {
+			if secretRE.MatchString(k) {
+				val = "[redacted]"
+			}
+			m[k] = val
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, val := range v {
+			s[i] = redactValue(val)
+		}
+		return s
+	}
+	return v
+}
+
+// rewrite inserts calls to the trace functions into t.
+func (tr *tracer) rewrite(t *parse.Tree) error {
+	return tr.rewriteList(t, t.Root, 0)
+}
+
+func (tr *tracer) rewriteList(t *parse.Tree, l *parse.ListNode, depth int) error {
+	if l == nil {
+		return nil
+	}
+	nodes := make([]parse.Node, 0, len(l.Nodes))
+	for _, n := range l.Nodes {
+		var err error
+		switch n := n.(type) {
+		case *parse.ActionNode:
+			if isCoverAction(n) || tr.html && endsWithEscaper(n.Pipe) {
+				break // html/template only allows its predefined escapers at the end of a pipeline
+			}
+			err = tr.wrapPipe(t, n, n.Pipe, "action", n.Pipe.String(), depth, "tmplTrace")
+		case *parse.IfNode:
+			err = tr.rewriteBranch(t, n, &n.BranchNode, "if", depth)
+		case *parse.WithNode:
+			err = tr.rewriteBranch(t, n, &n.BranchNode, "with", depth)
+		case *parse.RangeNode:
+			err = tr.rewriteBranch(t, n, &n.BranchNode, "range", depth)
+		case *parse.TemplateNode:
+			text := strconv.Quote(n.Name)
+			if n.Pipe != nil {
+				text += " " + n.Pipe.String()
+			}
+			id := tr.addSite(t, n, "template", text, depth)
+			call, err := parseAction(fmt.Sprintf("{{tmplTraceCall %d}}", id), tr.funcs())
+			if err != nil {
+				return err
+			}
+			if n.Pipe != nil {
+				n.Pipe.Cmds = append(n.Pipe.Cmds, call.(*parse.ActionNode).Pipe.Cmds[0])
+			} else {
+				nodes = append(nodes, call)
+			}
+			pop, err := parseAction("{{tmplTracePop}}", tr.funcs())
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, n, pop)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+	l.Nodes = nodes
+	return nil
+}
+
+func (tr *tracer) rewriteBranch(t *parse.Tree, n parse.Node, b *parse.BranchNode, kind string, depth int) error {
+	if err := tr.wrapPipe(t, n, b.Pipe, kind, b.Pipe.String(), depth, "tmplTraceCond"); err != nil {
+		return err
+	}
+	if err := tr.rewriteList(t, b.List, depth+1); err != nil {
+		return err
+	}
+	return tr.rewriteList(t, b.ElseList, depth+1)
+}
+
+// wrapPipe records a site for n and rewrites pipe to trace its arguments,
+// each intermediate command and, with the function final, its result.
+func (tr *tracer) wrapPipe(t *parse.Tree, n parse.Node, pipe *parse.PipeNode, kind, text string, depth int, final string) error {
+	id := tr.addSite(t, n, kind, text, depth)
+	site := &tr.sites[id]
+	var cmds []*parse.CommandNode
+	for k, cmd := range pipe.Cmds {
+		for i := 1; i < len(cmd.Args); i++ {
+			switch cmd.Args[i].(type) {
+			case *parse.FieldNode, *parse.VariableNode, *parse.ChainNode, *parse.PipeNode:
+			default:
+				continue
+			}
+			wrap, err := parseAction(fmt.Sprintf("{{(tmplTraceArg %d %d .)}}", id, len(site.args)), tr.funcs())
+			if err != nil {
+				return err
+			}
+			arg := wrap.(*parse.ActionNode).Pipe.Cmds[0].Args[0].(*parse.PipeNode)
+			site.args = append(site.args, cmd.Args[i].String())
+			arg.Cmds[0].Args[3] = cmd.Args[i]
+			cmd.Args[i] = arg
+		}
+		cmds = append(cmds, cmd)
+		if k < len(pipe.Cmds)-1 {
+			stage, err := parseAction(fmt.Sprintf("{{tmplTraceStage %d %d}}", id, len(site.stages)), tr.funcs())
+			if err != nil {
+				return err
+			}
+			site.stages = append(site.stages, cmd.String())
+			cmds = append(cmds, stage.(*parse.ActionNode).Pipe.Cmds[0])
+		}
+	}
+	end, err := parseAction(fmt.Sprintf("{{%s %d}}", final, id), tr.funcs())
+	if err != nil {
+		return err
+	}
+	pipe.Cmds = append(cmds, end.(*parse.ActionNode).Pipe.Cmds[0])
+	return nil
+}
+
+// endsWithEscaper reports whether pipe ends with one of html/template's predefined escapers.
+func endsWithEscaper(pipe *parse.PipeNode) bool {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	id, ok := last.Args[0].(*parse.IdentifierNode)
+	return ok && (id.Ident == "html" || id.Ident == "urlquery")
+}
+
+func (tr *tracer) addSite(t *parse.Tree, n parse.Node, kind, text string, depth int) int {
+	loc, _ := t.ErrorContext(n)
+	tr.sites = append(tr.sites, traceSite{pos: tr.position(loc), kind: kind, text: text, depth: depth})
+	return len(tr.sites) - 1
+}
+
+// position converts a parse location (name:line:col, col 0-based) to the
+// page's file name and 1-based line and column.
+func (tr *tracer) position(loc string) string {
+	i := strings.LastIndexByte(loc, ':')
+	j := strings.LastIndexByte(loc[:max(i, 0)], ':')
+	if i < 0 || j < 0 {
+		return loc
+	}
+	line, _ := strconv.Atoi(loc[j+1 : i])
+	col, _ := strconv.Atoi(loc[i+1:])
+	return fmt.Sprintf("%s:%d:%d", tr.page.displayName(), line+tr.page.offset, col+1)
+}
+
+// done writes the trace to stderr once the page has executed, passing through its error.
+// It does nothing if tr is nil.
+func (tr *tracer) done(err error) error {
+	if tr == nil {
+		return err
+	}
+	if werr := tr.write(os.Stderr); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// write prints the recorded trace to w in the -traceformat format.
+func (tr *tracer) write(w io.Writer) error {
+	// Events still pending were interrupted by an error.
+	ids := make([]int, 0, len(tr.pending))
+	for id := range tr.pending {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		ev := tr.finish(id)
+		ev.Result = "(error)"
+	}
+
+	if *flagTraceFormat == "json" {
+		events := tr.events
+		if events == nil {
+			events = []*traceEvent{}
+		}
+		b, err := json.Marshal(map[string]any{"template": tr.page.displayName(), "events": events})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "trace: %s\n", tr.page.displayName())
+	for _, ev := range tr.events {
+		indent := strings.Repeat("  ", ev.Depth+1)
+		text := ev.Text
+		if ev.Kind != "action" {
+			text = ev.Kind + " " + text
+		}
+		fmt.Fprintf(&b, "%s%s: %s => %s", indent, ev.Pos, text, ev.Result)
+		if ev.Branch != "" {
+			fmt.Fprintf(&b, " (%s)", ev.Branch)
+		}
+		b.WriteString("\n")
+		for _, a := range ev.Args {
+			fmt.Fprintf(&b, "%s    %s = %s\n", indent, a.Expr, a.Value)
+		}
+		for _, s := range ev.Stages {
+			fmt.Fprintf(&b, "%s    %s => %s\n", indent, s.Expr, s.Value)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import "strings"
+
+// blockKeywords are the actions affected by -trimblocks and -lstripblocks.
+// Actions that produce output (pipelines, template) are left untouched.
+var blockKeywords = map[string]bool{
+	"if":       true,
+	"else":     true,
+	"range":    true,
+	"with":     true,
+	"end":      true,
+	"define":   true,
+	"block":    true,
+	"break":    true,
+	"continue": true,
+	"file":     true,
+	"endfile":  true,
+
+	"component":    true,
+	"endcomponent": true,
+	"fill":         true,
+	"endfill":      true,
+}
+
+// stripBlocks rewrites src the way Jinja's trim_blocks and lstrip_blocks options do.
+// With trim, the first newline after a block action is removed from the output.
+// With lstrip, spaces and tabs between the start of a line and a block action are removed.
+func stripBlocks(src, left, right string, trim, lstrip bool) string {
+	s, _ := stripBlocksShifts(src, left, right, trim, lstrip)
+	return s
+}
+
+// stripBlocksShifts is stripBlocks, also returning by line how many bytes further right than
+// in src the text of the line is in the result. The rewrite keeps the number of lines, so the
+// shifts map columns in errors back to src.
+func stripBlocksShifts(src, left, right string, trim, lstrip bool) (string, map[int]int) {
+	shifts := map[int]int{}
+	if !trim && !lstrip {
+		return src, shifts
+	}
+	var b strings.Builder
+	lineStart := true
+	line := 1
+	for {
+		i := strings.Index(src, left)
+		if i < 0 {
+			b.WriteString(src)
+			break
+		}
+		n := actionEnd(src[i:], left, right)
+		if n < 0 {
+			// Unterminated action, leave it for the parser to report.
+			b.WriteString(src)
+			break
+		}
+		text, action := src[:i], src[i:i+n]
+		block := isBlockAction(action, left, right)
+		if block && lstrip {
+			t := strings.TrimRight(text, " \t")
+			if strings.HasSuffix(t, "\n") || (t == "" && lineStart) {
+				shifts[line+strings.Count(t, "\n")] -= len(text) - len(t)
+				text = t
+			}
+		}
+		b.WriteString(text)
+		b.WriteString(action)
+		line += strings.Count(text, "\n") + strings.Count(action, "\n")
+		src = src[i+n:]
+		lineStart = false
+		if block && trim {
+			for _, nl := range []string{"\r\n", "\n"} {
+				if strings.HasPrefix(src, nl) {
+					// Fold the newline into a comment so line numbers in errors still match the source.
+					b.WriteString(left + "/*" + nl + "*/" + right)
+					src = src[len(nl):]
+					line++
+					shifts[line] += len("*/" + right)
+					lineStart = true
+					break
+				}
+			}
+		}
+	}
+	return b.String(), shifts
+}
+
+// actionEnd returns the length of the action at the start of s, including both delimiters,
+// or -1 if the action is not terminated.
+func actionEnd(s, left, right string) int {
+	i := len(left)
+	if c := strings.TrimLeft(s[i:], "- "); strings.HasPrefix(c, "/*") {
+		k := strings.Index(c, "*/")
+		if k < 0 {
+			return -1
+		}
+		i = len(s) - len(c) + k + 2
+	}
+	for i < len(s) {
+		if strings.HasPrefix(s[i:], right) {
+			return i + len(right)
+		}
+		switch q := s[i]; q {
+		case '"', '\'', '`':
+			i++
+			for i < len(s) && s[i] != q {
+				if s[i] == '\\' && q != '`' {
+					i++
+				}
+				i++
+			}
+		}
+		i++
+	}
+	return -1
+}
+
+// isBlockAction reports whether action is a comment or starts with one of blockKeywords.
+func isBlockAction(action, left, right string) bool {
+	inner := strings.TrimSuffix(strings.TrimPrefix(action, left), right)
+	if len(inner) > 1 && inner[0] == '-' && strings.ContainsRune(" \t\r\n", rune(inner[1])) {
+		inner = inner[1:]
+	}
+	inner = strings.TrimSpace(inner)
+	if strings.HasPrefix(inner, "/*") {
+		return true
+	}
+	word := inner
+	if i := strings.IndexAny(inner, " \t\r\n"); i >= 0 {
+		word = inner[:i]
+	}
+	return blockKeywords[word]
+}